@@ -5,10 +5,10 @@
 package main
 
 import (
-	"database/sql"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -19,91 +19,195 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 
-	"github.com/go-gorp/gorp"
+	"github.com/jcjones/ct-sql/geoipdb"
+	"github.com/jcjones/ct-sql/netscan/resolver"
 	"github.com/jcjones/ct-sql/sqldb"
 	"github.com/jcjones/ct-sql/utils"
-	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type ResolutionEntry struct {
-	NameID uint64
-	Name   string
-	Time   *time.Time
-	Ipaddr *string
+// Prometheus metrics for scan progress and resolver health. These replace
+// the opaque progressDisplay stderr output as the thing a production
+// deployment actually monitors; progressDisplay stays for interactive runs.
+var (
+	resolutionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ct_sql_netscan_resolutions_total",
+		Help: "Count of DNS resolution attempts, labeled by outcome (success/failure) and, for failures, a coarse error class.",
+	}, []string{"outcome", "error_class"})
+
+	resolutionRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ct_sql_netscan_resolution_rtt_seconds",
+		Help:    "DNS lookup round-trip time, as reported by the active Resolver.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	geoipLookupFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ct_sql_netscan_geoip_lookup_failures_total",
+		Help: "Count of GeoIP City or ASN lookups that failed for a resolved IP.",
+	})
+
+	entryQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ct_sql_netscan_entry_queue_depth",
+		Help: "Number of claimed names currently buffered in entryChan awaiting a free worker.",
+	})
+
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ct_sql_netscan_workers_busy",
+		Help: "Number of resolveWorker goroutines currently processing a name.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(resolutionsTotal, resolutionRTT, geoipLookupFailures, entryQueueDepth, workersBusy)
+}
+
+// classifyResolveError buckets a DNS lookup error into the coarse label
+// resolutionsTotal reports, matching the error classes comparable scanners
+// use. Resolver implementations here don't return structured error types,
+// so this matches on the error string the same way errorIsNotDuplicate
+// does for MySQL errors elsewhere in this codebase.
+func classifyResolveError(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no such host"), strings.Contains(msg, "NXDOMAIN"):
+		return "nxdomain"
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "i/o timeout"):
+		return "timeout"
+	case strings.Contains(msg, "SERVFAIL"), strings.Contains(msg, "server failure"):
+		return "servfail"
+	default:
+		return "other"
+	}
 }
 
 var (
 	config = utils.NewCTConfig()
+
+	geoipLicenseKey = flag.String("geoip-license-key", "", "MaxMind GeoLite2 license key, used to auto-download/refresh the GeoIP database")
+	geoipRefresh    = flag.Bool("geoip-refresh", false, "Force an immediate GeoLite2 database re-download before scanning")
+	asnDbPath       = flag.String("asn-db", "", "Path to a GeoLite2-ASN database; enables ASN/ISP enrichment of resolved IPs")
+
+	qps        = flag.Int("qps", 0, "Rate limit shared across all workers, in lookups/sec (0 disables limiting)")
+	dnsServers = flag.String("dns-servers", "", "Comma-separated list of recursive servers to use with -dns-mode=dns (host:port) or -dns-mode=doh (URLs)")
+	dnsMode    = flag.String("dns-mode", "stdlib", "Resolver to use: stdlib, dns, or doh")
+
+	writeBatchSize     = flag.Int("write-batch-size", 500, "Number of resolution rows to accumulate before a batch INSERT")
+	writeFlushInterval = flag.Duration("write-flush-interval", time.Second, "Maximum time buffered resolution rows wait before being flushed")
+
+	workerID       = flag.String("worker-id", "", "Identifier recorded against leased netscanqueue rows; defaults to the hostname, so it should be overridden when running multiple workers on one host")
+	claimBatchSize = flag.Int("claim-batch-size", 500, "Number of netscanqueue rows to lease per ClaimBatch call")
+	leaseDuration  = flag.Duration("lease-duration", 5*time.Minute, "How long a claimed netscanqueue row stays leased before a reaper makes it claimable again")
+
+	metricsListen = flag.String("metrics-listen", "", "Address to serve Prometheus metrics on, e.g. \":9090\" (disabled if unset)")
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("")
-	dbConnectStr, err := sqldb.RecombineURLForDB(*config.DbConnect)
-	if err != nil {
-		log.Printf("unable to parse %s: %s", *config.DbConnect, err)
+	// Re-parse now that geoip-license-key and geoip-refresh are registered,
+	// in case utils.NewCTConfig already parsed before this file's flags
+	// were defined.
+	flag.Parse()
+
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				log.Printf("metrics listener on %s exited: %s", *metricsListen, err)
+			}
+		}()
 	}
 
-	if len(dbConnectStr) == 0 || len(*config.GeoipDbPath) == 0 {
+	if len(*config.DbConnect) == 0 || len(*config.GeoipDbPath) == 0 {
 		config.Usage()
 		os.Exit(2)
 	}
 
-	db, err := sql.Open("mysql", dbConnectStr)
+	entriesDb, err := sqldb.OpenEntriesDatabase(*config.DbConnect)
 	if err != nil {
-		log.Fatalf("unable to open SQL: %s: %s", dbConnectStr, err)
-	}
-	if err = db.Ping(); err != nil {
-		log.Fatalf("unable to ping SQL: %s: %s", dbConnectStr, err)
+		log.Fatalf("unable to open SQL: %s: %s", *config.DbConnect, err)
 	}
+	entriesDb.SQLDebug = *config.SQLDebug
+	entriesDb.Verbose = *config.Verbose
 
-	dialect := gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}
-	dbMap := &gorp.DbMap{Db: db, Dialect: dialect}
-	entriesDb := &sqldb.EntriesDatabase{
-		DbMap:        dbMap,
-		SQLDebug:     *config.SQLDebug,
-		Verbose:      *config.Verbose,
-		KnownIssuers: make(map[string]int),
-	}
-	err = entriesDb.InitTables()
-	if err != nil {
-		log.Fatalf("unable to prepare SQL DB. dbConnectStr=%s: %s", dbConnectStr, err)
+	if err := entriesDb.InitTables(); err != nil {
+		log.Fatalf("unable to prepare SQL DB. dbConnect=%s: %s", *config.DbConnect, err)
 	}
 
-	geoDB, err := geoip2.Open(*config.GeoipDbPath)
+	geoMgr, err := geoipdb.NewManager("GeoLite2-City", *geoipLicenseKey, *config.GeoipDbPath)
 	if err != nil {
 		log.Fatalf("unable to prepare GeoIP DB. geoipDbPath=%s: %s", *config.GeoipDbPath, err)
 	}
-	defer geoDB.Close()
 
-	netscan := &NetScan{
-		wg:    new(sync.WaitGroup),
-		db:    entriesDb,
-		geodb: geoDB,
+	if *geoipRefresh {
+		if err := geoMgr.Refresh(); err != nil {
+			log.Fatalf("unable to force-refresh GeoIP DB: %s", err)
+		}
 	}
 
-	if *config.Limit == 0 {
-		// Didn't include a mandatory action, so print usage and exit.
-		log.Fatalf("You must set a limit")
+	geoipStop := make(chan struct{})
+	go geoMgr.RunBackgroundRefresh(geoipStop)
+	defer close(geoipStop)
+
+	var asnMgr *geoipdb.Manager
+	if *asnDbPath != "" {
+		asnMgr, err = geoipdb.NewManager("GeoLite2-ASN", *geoipLicenseKey, *asnDbPath)
+		if err != nil {
+			log.Fatalf("unable to prepare ASN DB. asnDbPath=%s: %s", *asnDbPath, err)
+		}
+
+		asnStop := make(chan struct{})
+		go asnMgr.RunBackgroundRefresh(asnStop)
+		defer close(asnStop)
 	}
 
-	oldestAllowed := time.Now().AddDate(-1, 0, 0)
+	var servers []string
+	if *dnsServers != "" {
+		servers = strings.Split(*dnsServers, ",")
+	}
 
-	var entries []ResolutionEntry
-	_, err = dbMap.Select(&entries,
-		`SELECT q.nameID, f.name FROM netscanqueue AS q
-        NATURAL JOIN fqdn AS f
-        LIMIT :limit`,
-		map[string]interface{}{
-			"oldestAllowed": oldestAllowed,
-			"limit":         *config.Limit,
-		})
+	limiter := resolver.NewRateLimiter(*qps)
+	defer limiter.Close()
 
+	dnsResolver, err := resolver.New(*dnsMode, servers, limiter)
 	if err != nil {
-		log.Fatalf("unable to execute SQL: %s", err)
+		log.Fatalf("unable to construct resolver: %s", err)
+	}
+
+	writer := sqldb.NewResolutionWriter(entriesDb, *writeBatchSize, *writeFlushInterval)
+	writer.Start()
+	defer writer.Stop()
+
+	id := *workerID
+	if id == "" {
+		id, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("unable to determine hostname for -worker-id: %s", err)
+		}
+	}
+
+	reaperStop := make(chan struct{})
+	go runLeaseReaper(entriesDb, *leaseDuration, reaperStop)
+	defer close(reaperStop)
+
+	netscan := &NetScan{
+		wg:       new(sync.WaitGroup),
+		db:       entriesDb,
+		geodb:    geoMgr,
+		asndb:    asnMgr,
+		resolver: dnsResolver,
+		writer:   writer,
+		workerID: id,
+	}
+
+	if *config.Limit == 0 {
+		// Didn't include a mandatory action, so print usage and exit.
+		log.Fatalf("You must set a limit")
 	}
 
-	err = netscan.processEntries(entries)
+	err = netscan.processEntries()
 
 	if err != nil {
 		log.Fatalf("error while running importer: %s", err)
@@ -113,64 +217,154 @@ func main() {
 	os.Exit(0)
 }
 
+// runLeaseReaper periodically frees netscanqueue rows whose lease expired,
+// e.g. because the worker holding them crashed or was killed, so that a
+// ClaimBatch call elsewhere picks them back up. It runs until stop is
+// closed.
+func runLeaseReaper(db *sqldb.EntriesDatabase, leaseDuration time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(leaseDuration / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := db.ReapExpiredLeases(); err != nil {
+				log.Printf("Could not reap expired netscanqueue leases: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reportQueueDepth samples entryChan's buffered length into entryQueueDepth
+// until stop is closed.
+func reportQueueDepth(entryChan <-chan sqldb.NetscanClaim, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			entryQueueDepth.Set(float64(len(entryChan)))
+		case <-stop:
+			return
+		}
+	}
+}
+
 type NetScan struct {
-	db    *sqldb.EntriesDatabase
-	wg    *sync.WaitGroup
-	geodb *geoip2.Reader
+	db       *sqldb.EntriesDatabase
+	wg       *sync.WaitGroup
+	geodb    *geoipdb.Manager
+	asndb    *geoipdb.Manager // nil unless -asn-db was supplied
+	resolver resolver.Resolver
+	writer   *sqldb.ResolutionWriter
+	workerID string
 }
 
-func (ns *NetScan) resolveWorker(entries <-chan ResolutionEntry) {
+func (ns *NetScan) resolveWorker(entries <-chan sqldb.NetscanClaim) {
 	ns.wg.Add(1)
 	defer ns.wg.Done()
 	for e := range entries {
-		// Unqueue the nameID
-		err := ns.db.UnqueueFromNetscan(e.NameID)
-		if err != nil {
-			log.Printf("Could not dequeue host %s (ID=%d): %s", e.Name, e.NameID, err)
-			continue
-		}
+		workersBusy.Inc()
 
 		if strings.Contains(e.Name, "*") {
 			// Is a wildcard, we can't resolve it.
-			ns.db.InsertResolvedName(e.NameID, "")
+			done := ns.writer.PutName(e.NameID, "", false)
+			ns.ackAfter(e, done)
+			workersBusy.Dec()
 			continue
 		}
 
-		ips, err := net.LookupIP(e.Name)
+		result, err := ns.resolver.LookupIP(e.Name)
+		resolutionRTT.Observe(result.RTT.Seconds())
+		metaDone := ns.writer.PutMetadata(e.NameID, result.Server, result.RTT)
 		if err != nil {
+			resolutionsTotal.WithLabelValues("failure", classifyResolveError(err)).Inc()
 			if *config.Verbose {
 				log.Printf("Could not lookup host %s: %s", e.Name, err)
 			}
 
 			// Insert a blank record so we know this one didn't work in the future
-			ns.db.InsertResolvedName(e.NameID, "")
+			nameDone := ns.writer.PutName(e.NameID, "", false)
+			ns.ackAfter(e, metaDone, nameDone)
 			// Can't proceed with the geo work since the IP didn't resolve
+			workersBusy.Dec()
 			continue
 		}
+		resolutionsTotal.WithLabelValues("success", "").Inc()
+
+		dones := []<-chan error{metaDone}
+
+		// Record geo (and optionally ASN) data for every resolved IP, not
+		// just the first -- a hostname resolving to both a CDN IPv4 and
+		// IPv6 address previously lost the IPv6 entry entirely.
+		for _, ip := range result.IPs {
+			isIPv6 := ip.To4() == nil
+			dones = append(dones, ns.writer.PutName(e.NameID, ip.String(), isIPv6))
+
+			geoRecord, err := ns.geodb.Reader().City(ip)
+			if err != nil {
+				geoipLookupFailures.Inc()
+				if *config.Verbose {
+					log.Printf("Could not lookup geo-ip record for host %s (%s): %s", e.Name, ip, err)
+				}
+			} else {
+				dones = append(dones, ns.writer.PutPlace(e.NameID, geoRecord.City.Names["en"],
+					geoRecord.Country.IsoCode, geoRecord.Continent.Names["en"]))
+			}
 
-		// Log each resolved IP
-		for _, ip := range ips {
-			ns.db.InsertResolvedName(e.NameID, ip.String())
+			if ns.asndb != nil {
+				asnRecord, err := ns.asndb.Reader().ASN(ip)
+				if err != nil {
+					geoipLookupFailures.Inc()
+					if *config.Verbose {
+						log.Printf("Could not lookup ASN record for host %s (%s): %s", e.Name, ip, err)
+					}
+					continue
+				}
+				dones = append(dones, ns.writer.PutASN(e.NameID, ip.String(), asnRecord.AutonomousSystemNumber,
+					asnRecord.AutonomousSystemOrganization, asnRecord.Network.String()))
+			}
 		}
 
-		// Look up the geo-ip data for the first resolved IP
-		geoRecord, err := ns.geodb.City(ips[0])
-		if err != nil {
-			if *config.Verbose {
-				log.Printf("Could not lookup geo-ip record for host %s: %s", e.Name, err)
-			}
-			continue
+		ns.ackAfter(e, dones...)
+		workersBusy.Dec()
+	}
+}
+
+// ackAfter waits for every done channel returned by this entry's
+// ResolutionWriter.Put* calls, so it only acknowledges the claim once all of
+// them have durably committed, and acks it just once. If any flush failed,
+// the claim is deliberately left un-acked: AckResolution never runs, so the
+// netscanqueue row survives and ReapExpiredLeases requeues it once the lease
+// ClaimBatch took out on it expires, actually providing the at-least-once
+// guarantee this package depends on.
+func (ns *NetScan) ackAfter(claim sqldb.NetscanClaim, dones ...<-chan error) {
+	ok := true
+	for _, done := range dones {
+		if err := <-done; err != nil {
+			ok = false
+			log.Printf("Could not durably write resolution for host %s (ID=%d): %s", claim.Name, claim.NameID, err)
 		}
+	}
+	if !ok {
+		return
+	}
+	ns.ack(claim)
+}
 
-		// Log the geo-ip data
-		ns.db.InsertResolvedPlace(e.NameID, geoRecord.City.Names["en"],
-			geoRecord.Country.IsoCode, geoRecord.Continent.Names["en"])
+// ack acknowledges a claim whose resolution ackAfter has confirmed was
+// durably flushed to the database.
+func (ns *NetScan) ack(claim sqldb.NetscanClaim) {
+	if err := ns.db.AckResolution(claim.NameID); err != nil {
+		log.Printf("Could not ack host %s (ID=%d): %s", claim.Name, claim.NameID, err)
 	}
 }
 
-func (ns *NetScan) processEntries(entries []ResolutionEntry) error {
-	entryChan := make(chan ResolutionEntry, 10)
-	defer close(entryChan)
+func (ns *NetScan) processEntries() error {
+	entryChan := make(chan sqldb.NetscanClaim, 10)
 	ns.wg.Add(1)
 	defer ns.wg.Done()
 	progressDisplay := utils.NewProgressDisplay()
@@ -188,16 +382,53 @@ func (ns *NetScan) processEntries(entries []ResolutionEntry) error {
 		go ns.resolveWorker(entryChan)
 	}
 
-	for i, entry := range entries {
+	queueDepthStop := make(chan struct{})
+	defer close(queueDepthStop)
+	go reportQueueDepth(entryChan, queueDepthStop)
+
+	// Claim and hand off batches until the queue is drained or a signal
+	// arrives. Closing entryChan (rather than returning an error, as this
+	// used to) lets every resolveWorker finish whatever it already has
+	// buffered and exit its range loop cleanly, so the caller's wg.Wait()
+	// returns instead of leaving workers blocked forever.
+	var claimed uint64
+	for {
 		select {
-		case entryChan <- entry:
-			if i%256 == 0 {
-				progressDisplay.UpdateProgress("Scanner", 0, uint64(i), uint64(len(entries)))
-			}
 		case sig := <-sigChan:
-			return fmt.Errorf("Signal caught: %s", sig)
+			log.Printf("Signal caught: %s, draining in-flight work", sig)
+			close(entryChan)
+			return nil
+		default:
+		}
+
+		claims, err := ns.db.ClaimBatch(ns.workerID, *claimBatchSize, *leaseDuration)
+		if err != nil {
+			close(entryChan)
+			return fmt.Errorf("unable to claim netscanqueue work: %s", err)
+		}
+		if len(claims) == 0 {
+			break
+		}
+
+		for _, claim := range claims {
+			select {
+			case entryChan <- claim:
+				claimed++
+				if claimed%256 == 0 {
+					progressDisplay.UpdateProgress("Scanner", 0, claimed, claimed)
+				}
+			case sig := <-sigChan:
+				log.Printf("Signal caught: %s, draining in-flight work", sig)
+				close(entryChan)
+				return nil
+			}
+		}
+
+		if claimed >= uint64(*config.Limit) {
+			break
 		}
 	}
 
+	close(entryChan)
 	return nil
 }
@@ -0,0 +1,229 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package geoipdb manages the lifecycle of a MaxMind GeoLite2 database:
+// downloading it on first run, verifying its checksum, and refreshing it on
+// a best-effort schedule without ever blocking a reader.
+package geoipdb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	downloadURLFormat = "https://download.maxmind.com/app/geoip_download?edition_id=%s&license_key=%s&suffix=tar.gz"
+	checksumURLFormat = downloadURLFormat + ".sha256"
+
+	// RefreshInterval is how often Manager attempts a best-effort refresh.
+	RefreshInterval = 7 * 24 * time.Hour
+
+	// MaxDbSizeBytes caps the size of a downloaded database; MaxMind's
+	// GeoLite2-City and GeoLite2-ASN databases are both well under this.
+	MaxDbSizeBytes = 256 * 1024 * 1024
+
+	// readerCloseDelay is how long a reader replaced by Refresh stays open.
+	readerCloseDelay = time.Minute
+)
+
+// Manager owns a single GeoLite2 database on disk, keeping an always-valid
+// *geoip2.Reader available via Reader() without requiring callers to take a
+// lock.
+type Manager struct {
+	EditionID  string
+	LicenseKey string
+	DbPath     string
+
+	reader atomic.Pointer[geoip2.Reader]
+}
+
+// NewManager returns a Manager for editionID (e.g. "GeoLite2-City" or
+// "GeoLite2-ASN"), downloading into dbPath if it doesn't already exist.
+func NewManager(editionID, licenseKey, dbPath string) (*Manager, error) {
+	m := &Manager{
+		EditionID:  editionID,
+		LicenseKey: licenseKey,
+		DbPath:     dbPath,
+	}
+
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		if err := m.download(); err != nil {
+			return nil, fmt.Errorf("unable to fetch initial %s database: %s", editionID, err)
+		}
+	}
+
+	reader, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s database at %s: %s", editionID, dbPath, err)
+	}
+	m.reader.Store(reader)
+
+	return m, nil
+}
+
+// Reader returns the current reader. It is safe to call concurrently with
+// Refresh; readers never see a torn database, and Refresh closes the reader
+// it replaces only after readerCloseDelay, so a lookup already under way on
+// it is not cut off.
+func (m *Manager) Reader() *geoip2.Reader {
+	return m.reader.Load()
+}
+
+// RunBackgroundRefresh refreshes the database every RefreshInterval until
+// stop is closed. Failures are logged and the previous reader keeps serving.
+func (m *Manager) RunBackgroundRefresh(stop <-chan struct{}) {
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Refresh(); err != nil {
+				log.Printf("geoipdb: refresh of %s failed, continuing to serve the previous database: %s",
+					m.EditionID, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Refresh re-downloads the database and atomically swaps it into place if
+// the download succeeds and its checksum verifies.
+func (m *Manager) Refresh() error {
+	if err := m.download(); err != nil {
+		return err
+	}
+
+	reader, err := geoip2.Open(m.DbPath)
+	if err != nil {
+		return fmt.Errorf("unable to open refreshed %s database: %s", m.EditionID, err)
+	}
+
+	old := m.reader.Swap(reader)
+	if old != nil {
+		time.AfterFunc(readerCloseDelay, func() { old.Close() })
+	}
+	return nil
+}
+
+// download fetches the latest tar.gz for EditionID, verifies it against
+// MaxMind's published SHA256, and atomically replaces DbPath with the
+// extracted .mmdb file.
+func (m *Manager) download() error {
+	downloadURL := fmt.Sprintf(downloadURLFormat, m.EditionID, m.LicenseKey)
+	checksumURL := fmt.Sprintf(checksumURLFormat, m.EditionID, m.LicenseKey)
+
+	expectedSum, err := fetchChecksum(checksumURL)
+	if err != nil {
+		return fmt.Errorf("unable to fetch published checksum: %s", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(m.DbPath), "geoipdb-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	resp, err := http.Get(downloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hasher), io.LimitReader(resp.Body, MaxDbSizeBytes))
+	if err != nil {
+		return err
+	}
+	if written >= MaxDbSizeBytes {
+		return fmt.Errorf("refusing to accept a %s database larger than %d bytes", m.EditionID, MaxDbSizeBytes)
+	}
+
+	actualSum := hex.EncodeToString(hasher.Sum(nil))
+	if actualSum != expectedSum {
+		return fmt.Errorf("checksum mismatch for %s: got %s, expected %s", m.EditionID, actualSum, expectedSum)
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return extractMmdb(tmpFile, m.DbPath)
+}
+
+// extractMmdb unpacks the single .mmdb file out of the MaxMind tar.gz into
+// a temp file alongside dest, then renames it into place atomically.
+func extractMmdb(tarGz io.Reader, dest string) error {
+	gzr, err := gzip.NewReader(tarGz)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no .mmdb file found in archive")
+		}
+		if err != nil {
+			return err
+		}
+
+		if filepath.Ext(hdr.Name) != ".mmdb" {
+			continue
+		}
+
+		outFile, err := os.CreateTemp(filepath.Dir(dest), "geoipdb-*.mmdb")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(outFile.Name())
+
+		if _, err := io.Copy(outFile, tr); err != nil {
+			outFile.Close()
+			return err
+		}
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+
+		return os.Rename(outFile.Name(), dest)
+	}
+}
+
+func fetchChecksum(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	// MaxMind's .sha256 files are formatted as "<hex sum>  <filename>\n".
+	for i, c := range body {
+		if c == ' ' || c == '\n' {
+			return string(body[:i]), nil
+		}
+	}
+	return string(body), nil
+}
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSResolver issues direct UDP (falling back to TCP on truncation) queries
+// against a user-supplied list of recursive servers, round-robining between
+// them and backing off a server for a while after a failure.
+type DNSResolver struct {
+	Limiter *RateLimiter
+
+	client  *dns.Client
+	servers []string
+	next    uint32 // atomically incremented round-robin cursor
+
+	mu         sync.Mutex
+	backoffTil map[string]time.Time
+}
+
+// NewDNSResolver returns a DNSResolver that queries servers (host:port, e.g.
+// "8.8.8.8:53") round-robin.
+func NewDNSResolver(servers []string, limiter *RateLimiter) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("dns resolver mode requires at least one -dns-servers entry")
+	}
+
+	return &DNSResolver{
+		Limiter:    limiter,
+		client:     &dns.Client{Timeout: 5 * time.Second},
+		servers:    servers,
+		backoffTil: make(map[string]time.Time),
+	}, nil
+}
+
+func (r *DNSResolver) LookupIP(name string) (Result, error) {
+	if r.Limiter != nil {
+		r.Limiter.Wait()
+	}
+
+	server := r.pickServer()
+
+	start := time.Now()
+	ips, err := r.queryBoth(name, server)
+	rtt := time.Since(start)
+
+	if err != nil {
+		r.markFailed(server)
+		return Result{Server: server, RTT: rtt}, err
+	}
+
+	return Result{IPs: ips, Server: server, RTT: rtt}, nil
+}
+
+// pickServer round-robins across servers, skipping any currently in
+// backoff, unless every server is in backoff.
+func (r *DNSResolver) pickServer() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(r.servers); i++ {
+		idx := int(atomic.AddUint32(&r.next, 1)) % len(r.servers)
+		candidate := r.servers[idx]
+		if until, backingOff := r.backoffTil[candidate]; !backingOff || now.After(until) {
+			return candidate
+		}
+	}
+
+	// Every server is backing off; use the next one anyway.
+	idx := int(atomic.AddUint32(&r.next, 1)) % len(r.servers)
+	return r.servers[idx]
+}
+
+func (r *DNSResolver) markFailed(server string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backoffTil[server] = time.Now().Add(30 * time.Second)
+}
+
+// queryBoth issues A and AAAA queries against server and merges the
+// results, retrying over TCP if either answer was truncated.
+func (r *DNSResolver) queryBoth(name string, server string) ([]net.IP, error) {
+	var ips []net.IP
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), qtype)
+
+		resp, _, err := r.client.Exchange(msg, server)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Truncated {
+			tcpClient := &dns.Client{Net: "tcp", Timeout: r.client.Timeout}
+			resp, _, err = tcpClient.Exchange(msg, server)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, rr := range resp.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				ips = append(ips, record.A)
+			case *dns.AAAA:
+				ips = append(ips, record.AAAA)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no A/AAAA records found for %s via %s", name, server)
+	}
+
+	return ips, nil
+}
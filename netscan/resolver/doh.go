@@ -0,0 +1,107 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package resolver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoHResolver resolves names via DNS-over-HTTPS (RFC 8484), round-robining
+// across the supplied endpoint URLs.
+type DoHResolver struct {
+	Limiter *RateLimiter
+
+	client    *http.Client
+	endpoints []string
+	next      uint32
+}
+
+// NewDoHResolver returns a DoHResolver querying endpoints (full URLs, e.g.
+// "https://dns.google/dns-query") round-robin.
+func NewDoHResolver(endpoints []string, limiter *RateLimiter) (*DoHResolver, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("doh resolver mode requires at least one -dns-servers entry")
+	}
+
+	return &DoHResolver{
+		Limiter:   limiter,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		endpoints: endpoints,
+	}, nil
+}
+
+func (r *DoHResolver) LookupIP(name string) (Result, error) {
+	if r.Limiter != nil {
+		r.Limiter.Wait()
+	}
+
+	endpoint := r.endpoints[int(atomic.AddUint32(&r.next, 1))%len(r.endpoints)]
+
+	start := time.Now()
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		found, err := r.query(endpoint, name, qtype)
+		if err != nil {
+			return Result{Server: endpoint, RTT: time.Since(start)}, err
+		}
+		ips = append(ips, found...)
+	}
+
+	return Result{IPs: ips, Server: endpoint, RTT: time.Since(start)}, nil
+}
+
+// query issues a single RFC 8484 GET request of the wire-format DNS message,
+// base64url-encoded into the "dns" query parameter.
+func (r *DoHResolver) query(endpoint, name string, qtype uint16) ([]net.IP, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(packed)
+	req, err := http.NewRequest("GET", endpoint+"?dns="+encoded, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, rr := range respMsg.Answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, record.A)
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package resolver
+
+import "time"
+
+// RateLimiter is a simple token bucket shared across every resolveWorker, so
+// a large scan doesn't hammer a single recursive server. It refills at qps
+// tokens/sec up to a burst of qps tokens.
+type RateLimiter struct {
+	tokens chan struct{}
+	stop   chan struct{}
+}
+
+// NewRateLimiter starts a RateLimiter that permits qps lookups per second.
+// A qps of zero or less disables limiting (Wait always returns immediately).
+func NewRateLimiter(qps int) *RateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+
+	rl := &RateLimiter{
+		tokens: make(chan struct{}, qps),
+		stop:   make(chan struct{}),
+	}
+
+	for i := 0; i < qps; i++ {
+		rl.tokens <- struct{}{}
+	}
+
+	interval := time.Second / time.Duration(qps)
+	go rl.refill(interval)
+
+	return rl
+}
+
+func (rl *RateLimiter) refill(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case rl.tokens <- struct{}{}:
+		default:
+			// Bucket already full.
+		}
+
+		select {
+		case <-ticker.C:
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+// Wait blocks until a token is available.
+func (rl *RateLimiter) Wait() {
+	if rl == nil {
+		return
+	}
+	<-rl.tokens
+}
+
+// Close stops the background refill goroutine.
+func (rl *RateLimiter) Close() {
+	if rl == nil {
+		return
+	}
+	close(rl.stop)
+}
@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package resolver provides a pluggable DNS resolution strategy for the
+// netscan worker pool: the stdlib resolver, direct queries against a
+// user-supplied list of recursive servers, or DNS-over-HTTPS. Every
+// implementation reports which server answered and how long it took, so
+// callers can record resolution_metadata without each Resolver needing to
+// know about storage.
+package resolver
+
+import (
+	"net"
+	"time"
+)
+
+// Result is what every Resolver implementation returns for a single lookup.
+type Result struct {
+	IPs    []net.IP
+	Server string        // The resolver/server that produced this answer
+	RTT    time.Duration // How long the lookup took
+}
+
+// Resolver looks up the IP addresses for name.
+type Resolver interface {
+	LookupIP(name string) (Result, error)
+}
+
+// New constructs a Resolver for mode ("stdlib", "dns", or "doh"), given the
+// list of servers (ignored by "stdlib") and a shared
+// RateLimiter (nil disables rate limiting).
+func New(mode string, servers []string, limiter *RateLimiter) (Resolver, error) {
+	switch mode {
+	case "", "stdlib":
+		return &StdResolver{Limiter: limiter}, nil
+	case "dns":
+		return NewDNSResolver(servers, limiter)
+	case "doh":
+		return NewDoHResolver(servers, limiter)
+	default:
+		return nil, &UnsupportedModeError{Mode: mode}
+	}
+}
+
+// UnsupportedModeError is returned by New for an unrecognized mode string.
+type UnsupportedModeError struct {
+	Mode string
+}
+
+func (e *UnsupportedModeError) Error() string {
+	return "unsupported resolver mode: " + e.Mode
+}
+
+// StdResolver wraps net.LookupIP, the resolver this package replaces by
+// default.
+type StdResolver struct {
+	Limiter *RateLimiter
+}
+
+func (r *StdResolver) LookupIP(name string) (Result, error) {
+	if r.Limiter != nil {
+		r.Limiter.Wait()
+	}
+
+	start := time.Now()
+	ips, err := net.LookupIP(name)
+	rtt := time.Since(start)
+
+	if err != nil {
+		return Result{RTT: rtt, Server: "stdlib"}, err
+	}
+	return Result{IPs: ips, Server: "stdlib", RTT: rtt}, nil
+}
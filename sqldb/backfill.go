@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+)
+
+// BackfillSHA256 is the one-off job referenced by migration
+// 0002_certificate_sha256: for every certificate row left over from before
+// the sha256 column existed (left NULL by that migration), it reads the raw
+// DER back from FullCerts' legacy issuerID/serial layout, computes its
+// SHA-256, restores it under the new content-addressed path, and updates
+// the row. It is safe to run repeatedly and safe to run against a live
+// ingest, since it only ever touches rows that are still NULL.
+func (edb *EntriesDatabase) BackfillSHA256() (int, error) {
+	if edb.FullCerts == nil {
+		return 0, fmt.Errorf("BackfillSHA256 requires FullCerts to be configured")
+	}
+
+	type unfingerprintedCert struct {
+		CertID   uint64 `db:"certID"`
+		IssuerID int    `db:"issuerID"`
+		Serial   string `db:"serial"`
+	}
+
+	var rows []unfingerprintedCert
+	_, err := edb.DbMap.Select(&rows, "SELECT certID, issuerID, serial FROM certificate WHERE sha256 IS NULL")
+	if err != nil {
+		return 0, err
+	}
+
+	var backfilled int
+	for _, r := range rows {
+		der, err := edb.FullCerts.FetchBySerial(r.IssuerID, r.Serial)
+		if err != nil {
+			log.Printf("BackfillSHA256: skipping certID %d (issuerID=%d serial=%s): %s", r.CertID, r.IssuerID, r.Serial, err)
+			continue
+		}
+
+		fingerprint := fmt.Sprintf("%x", sha256.Sum256(der))
+		if err := edb.FullCerts.StoreByFingerprint(fingerprint, der); err != nil {
+			return backfilled, fmt.Errorf("certID %d: storing by fingerprint: %s", r.CertID, err)
+		}
+
+		if _, err := edb.DbMap.Exec("UPDATE certificate SET sha256 = ? WHERE certID = ?", fingerprint, r.CertID); err != nil {
+			return backfilled, fmt.Errorf("certID %d: updating sha256 column: %s", r.CertID, err)
+		}
+
+		backfilled++
+	}
+
+	return backfilled, nil
+}
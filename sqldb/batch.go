@@ -0,0 +1,472 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gorp/gorp"
+	"github.com/google/certificate-transparency/go/x509"
+	"github.com/jpillora/backoff"
+)
+
+// Stats is an injectable counter interface for the insertion pipeline,
+// modeled on the submission counters used by CT observatories. Callers that
+// don't care can leave it nil; every call site guards against that.
+type Stats interface {
+	IncSubmissions(n int)
+	ObserveBatchFlush(d time.Duration)
+	IncDuplicates(n int)
+}
+
+// pendingCert is a single certificate queued for a future batch flush.
+type pendingCert struct {
+	cert   *x509.Certificate
+	result chan error
+}
+
+// preparedCert is a pendingCert with everything resolved ahead of the bulk
+// SQL statements in flush: its issuer, its serial/fingerprint, the names it
+// carries, and (once bulkInsertCertificates runs) its certID.
+type preparedCert struct {
+	p           *pendingCert
+	issuerID    int
+	serial      string
+	fingerprint string
+	names       map[string]struct{}
+	nameIDs     []uint64
+	certID      uint64
+}
+
+// BatchInserter accumulates parsed certificates and flushes them together,
+// so a busy log import does not pay for a gorp transaction per certificate.
+// It fronts issuer and FQDN lookups with a bounded LRU of the hottest
+// names/issuers to avoid re-querying the DB for every repeat. Within a
+// single flush the FQDN lookups for distinct rows are coalesced by the
+// batch's own multi-row statements, and issuers are resolved one row at a
+// time through issuerCache. There is no singleflight layer coalescing
+// lookups across concurrent flushes.
+type BatchInserter struct {
+	Db        *EntriesDatabase
+	BatchSize int
+	Stats     Stats
+
+	mu      sync.Mutex
+	pending []*pendingCert
+
+	issuerCache *lruCache
+	nameCache   *lruCache
+}
+
+// NewBatchInserter returns a BatchInserter that flushes every batchSize
+// certificates, keeping up to cacheSize hot issuer/FQDN lookups in memory.
+func NewBatchInserter(db *EntriesDatabase, batchSize, cacheSize int) *BatchInserter {
+	return &BatchInserter{
+		Db:          db,
+		BatchSize:   batchSize,
+		issuerCache: newLRUCache(cacheSize),
+		nameCache:   newLRUCache(cacheSize),
+	}
+}
+
+// Add queues cert for insertion and blocks until the batch containing it has
+// been flushed, returning whatever error the flush produced for this cert.
+func (b *BatchInserter) Add(cert *x509.Certificate) error {
+	p := &pendingCert{
+		cert:   cert,
+		result: make(chan error, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, p)
+	shouldFlush := len(b.pending) >= b.BatchSize
+	var batch []*pendingCert
+	if shouldFlush {
+		batch = b.pending
+		b.pending = nil
+	}
+	b.mu.Unlock()
+
+	if shouldFlush {
+		b.flush(batch)
+	}
+
+	return <-p.result
+}
+
+// Flush forces out whatever certificates are currently queued, regardless of
+// BatchSize. Callers should call this on a timer so a slow trickle of
+// certificates doesn't wait forever for a batch to fill.
+func (b *BatchInserter) Flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.flush(batch)
+	}
+}
+
+// flush writes out a single batch inside one shared transaction: one
+// multi-row INSERT for the certificate rows, one for the FQDN rows, one for
+// the cert_fqdn links, and one for unexpired_certificate, instead of a
+// transaction (and several single-row statements) per certificate. A hard
+// SQL failure at any stage rolls back and fails every certificate still in
+// the batch, since they now share one transaction.
+func (b *BatchInserter) flush(batch []*pendingCert) {
+	start := time.Now()
+	var dupCount int
+
+	defer func() {
+		if b.Stats != nil {
+			b.Stats.IncSubmissions(len(batch))
+			b.Stats.ObserveBatchFlush(time.Since(start))
+			if dupCount > 0 {
+				b.Stats.IncDuplicates(dupCount)
+			}
+		}
+	}()
+
+	txn, err := b.Db.DbMap.Begin()
+	if err != nil {
+		for _, p := range batch {
+			p.result <- err
+		}
+		return
+	}
+
+	rows := make([]*preparedCert, 0, len(batch))
+	for _, p := range batch {
+		issuerID, err := b.resolveIssuerID(txn, p.cert)
+		if err != nil {
+			p.result <- err
+			continue
+		}
+
+		names := make(map[string]struct{})
+		if p.cert.Subject.CommonName != "" {
+			names[p.cert.Subject.CommonName] = struct{}{}
+		}
+		for _, name := range p.cert.DNSNames {
+			names[name] = struct{}{}
+		}
+
+		rows = append(rows, &preparedCert{
+			p:           p,
+			issuerID:    issuerID,
+			serial:      fmt.Sprintf("%036x", p.cert.SerialNumber),
+			fingerprint: fmt.Sprintf("%x", sha256.Sum256(p.cert.Raw)),
+			names:       names,
+		})
+	}
+
+	if len(rows) == 0 {
+		txn.Rollback()
+		return
+	}
+
+	fail := func(err error) {
+		txn.Rollback()
+		for _, r := range rows {
+			r.p.result <- err
+		}
+	}
+
+	dupCount, err = b.bulkInsertCertificates(txn, rows)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if err := b.bulkInsertNames(txn, rows); err != nil {
+		fail(err)
+		return
+	}
+
+	if err := b.bulkInsertCertFQDNs(txn, rows); err != nil {
+		fail(err)
+		return
+	}
+
+	if err := b.bulkInsertUnexpired(txn, rows); err != nil {
+		fail(err)
+		return
+	}
+
+	for _, r := range rows {
+		if b.Db.FullCerts != nil {
+			if err := b.Db.FullCerts.StoreByFingerprint(r.fingerprint, r.p.cert.Raw); err != nil {
+				fail(fmt.Errorf("DB error on raw certificate: %d: %s", r.certID, err))
+				return
+			}
+		}
+
+		if err := b.Db.insertRegisteredDomains(txn, r.certID, r.names); err != nil {
+			fail(fmt.Errorf("DB error on certId %d registered domains: %s", r.certID, err))
+			return
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		for _, r := range rows {
+			r.p.result <- err
+		}
+		return
+	}
+
+	for _, r := range rows {
+		r.p.result <- nil
+	}
+}
+
+// bulkInsertCertificates inserts every row's certificate with a single
+// multi-row INSERT ... ON DUPLICATE KEY UPDATE, tolerating re-issued certs
+// that collide on the sha256 unique key without a per-cert round trip, then
+// fills in each row's certID and returns how many rows were already present
+// (for Stats.IncDuplicates).
+func (b *BatchInserter) bulkInsertCertificates(txn *gorp.Transaction, rows []*preparedCert) (int, error) {
+	fingerprints := make([]interface{}, len(rows))
+	for i, r := range rows {
+		fingerprints[i] = r.fingerprint
+	}
+	inClause := placeholders(len(rows))
+
+	var existing int
+	if err := txn.SelectOne(&existing,
+		fmt.Sprintf("SELECT COUNT(*) FROM certificate WHERE sha256 IN (%s)", inClause),
+		fingerprints...); err != nil {
+		return 0, fmt.Errorf("DB error counting existing certificates: %s", err)
+	}
+
+	valuePlaceholders := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*6)
+	for i, r := range rows {
+		valuePlaceholders[i] = "(?, ?, ?, ?, ?, ?)"
+		args = append(args, r.serial, r.issuerID, r.p.cert.Subject.CommonName,
+			r.p.cert.NotBefore.UTC(), r.p.cert.NotAfter.UTC(), r.fingerprint)
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO certificate (serial, issuerID, subject, notBefore, notAfter, sha256)
+		VALUES %s ON DUPLICATE KEY UPDATE certID = certID`,
+		strings.Join(valuePlaceholders, ", "))
+	if _, err := txn.Exec(query, args...); err != nil {
+		return 0, fmt.Errorf("DB error on batch cert insertion: %s", err)
+	}
+
+	type certRow struct {
+		CertID uint64 `db:"certID"`
+		SHA256 string `db:"sha256"`
+	}
+	var found []certRow
+	if _, err := txn.Select(&found,
+		fmt.Sprintf("SELECT certID, sha256 FROM certificate WHERE sha256 IN (%s)", inClause),
+		fingerprints...); err != nil {
+		return 0, fmt.Errorf("DB error fetching certIDs after batch insert: %s", err)
+	}
+
+	byFingerprint := make(map[string]uint64, len(found))
+	for _, f := range found {
+		byFingerprint[f.SHA256] = f.CertID
+	}
+	for _, r := range rows {
+		certID, ok := byFingerprint[r.fingerprint]
+		if !ok {
+			return existing, fmt.Errorf("failed to obtain a certId for certificate serial=%s", r.serial)
+		}
+		r.certID = certID
+	}
+
+	return existing, nil
+}
+
+// bulkInsertNames resolves every distinct FQDN referenced by rows to a
+// nameID, fronting the lookup with nameCache so names seen in a previous
+// flush don't round-trip the DB again, and fills in each row's nameIDs so
+// bulkInsertCertFQDNs can link them.
+func (b *BatchInserter) bulkInsertNames(txn *gorp.Transaction, rows []*preparedCert) error {
+	resolved := make(map[string]uint64)
+	var unresolved []string
+	seen := make(map[string]struct{})
+
+	for _, r := range rows {
+		for name := range r.names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+
+			if v, ok := b.nameCache.Get(name); ok {
+				resolved[name] = v.(uint64)
+			} else {
+				unresolved = append(unresolved, name)
+			}
+		}
+	}
+
+	if len(unresolved) > 0 {
+		args := make([]interface{}, len(unresolved))
+		valuePlaceholders := make([]string, len(unresolved))
+		for i, name := range unresolved {
+			args[i] = name
+			valuePlaceholders[i] = "(?)"
+		}
+
+		query := fmt.Sprintf("INSERT INTO fqdn (name) VALUES %s ON DUPLICATE KEY UPDATE nameID = nameID",
+			strings.Join(valuePlaceholders, ", "))
+		if _, err := txn.Exec(query, args...); err != nil {
+			return fmt.Errorf("DB error on batch FQDN insertion: %s", err)
+		}
+
+		type nameRow struct {
+			NameID uint64 `db:"nameID"`
+			Name   string `db:"name"`
+		}
+		var found []nameRow
+		if _, err := txn.Select(&found,
+			fmt.Sprintf("SELECT nameID, name FROM fqdn WHERE name IN (%s)", placeholders(len(unresolved))),
+			args...); err != nil {
+			return fmt.Errorf("DB error fetching nameIDs after batch insert: %s", err)
+		}
+
+		for _, f := range found {
+			resolved[f.Name] = f.NameID
+			b.nameCache.Add(f.Name, f.NameID)
+		}
+	}
+
+	for _, r := range rows {
+		r.nameIDs = make([]uint64, 0, len(r.names))
+		for name := range r.names {
+			nameID, ok := resolved[name]
+			if !ok {
+				return fmt.Errorf("failed to resolve nameID for %s", name)
+			}
+			r.nameIDs = append(r.nameIDs, nameID)
+		}
+	}
+
+	return nil
+}
+
+// bulkInsertCertFQDNs links every row's certID to its nameIDs with a single
+// multi-row INSERT IGNORE, ignoring the (certID, nameID) duplicates that
+// reprocessing an already-seen cert produces.
+func (b *BatchInserter) bulkInsertCertFQDNs(txn *gorp.Transaction, rows []*preparedCert) error {
+	var valuePlaceholders []string
+	var args []interface{}
+	for _, r := range rows {
+		for _, nameID := range r.nameIDs {
+			valuePlaceholders = append(valuePlaceholders, "(?, ?)")
+			args = append(args, r.certID, nameID)
+		}
+	}
+	if len(valuePlaceholders) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf("INSERT IGNORE INTO cert_fqdn (certID, nameID) VALUES %s", strings.Join(valuePlaceholders, ", "))
+	if _, err := txn.Exec(query, args...); err != nil {
+		return fmt.Errorf("DB error on batch cert_fqdn insertion: %s", err)
+	}
+	return nil
+}
+
+// bulkInsertUnexpired inserts an unexpired_certificate row for every row
+// whose cert is currently valid, matching the single-cert path's NotBefore/
+// NotAfter window check.
+func (b *BatchInserter) bulkInsertUnexpired(txn *gorp.Transaction, rows []*preparedCert) error {
+	now := time.Now()
+
+	var valuePlaceholders []string
+	var args []interface{}
+	for _, r := range rows {
+		if !r.p.cert.NotBefore.Before(now) || !r.p.cert.NotAfter.After(now) {
+			continue
+		}
+		valuePlaceholders = append(valuePlaceholders, "(?, ?, ?, ?)")
+		args = append(args, r.certID, r.issuerID,
+			r.p.cert.NotBefore.UTC().Format("2006-01-02"), r.p.cert.NotAfter.UTC().Format("2006-01-02"))
+	}
+	if len(valuePlaceholders) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(
+		"INSERT IGNORE INTO unexpired_certificate (certID, issuerID, notBefore, notAfter) VALUES %s",
+		strings.Join(valuePlaceholders, ", "))
+	if _, err := txn.Exec(query, args...); err != nil {
+		return fmt.Errorf("DB error on batch unexpired cert insertion: %s", err)
+	}
+	return nil
+}
+
+// resolveIssuerID looks up the issuerID for cert, checking (in order)
+// BatchInserter's own issuerCache, EntriesDatabase.KnownIssuers, and finally
+// the issuer table itself, inserting a new Issuer row (like insertCertificate
+// does for the single-cert path) if none of those already have it. A new
+// issuer is resolved/inserted inside txn, the same transaction the rest of
+// the batch commits in, so a rolled-back flush doesn't leave a row in
+// KnownIssuers that the DB then forgets. The cache key must match
+// KnownIssuers' own key (base64, set in insertCertificate), not an arbitrary
+// encoding of the same bytes.
+func (b *BatchInserter) resolveIssuerID(txn *gorp.Transaction, cert *x509.Certificate) (int, error) {
+	aki := base64.StdEncoding.EncodeToString(cert.AuthorityKeyId)
+
+	if v, ok := b.issuerCache.Get(aki); ok {
+		return v.(int), nil
+	}
+
+	b.Db.IssuersLock.RLock()
+	issuerID, ok := b.Db.KnownIssuers[aki]
+	b.Db.IssuersLock.RUnlock()
+
+	if !ok {
+		backoff := &backoff.Backoff{Jitter: true}
+		for {
+			err := txn.SelectOne(&issuerID, "SELECT issuerID FROM issuer WHERE authorityKeyID = ?", aki)
+			if err == nil {
+				break
+			}
+
+			issuerObj := &Issuer{AuthorityKeyId: aki, CommonName: cert.Issuer.CommonName}
+			err = txn.Insert(issuerObj)
+			if err == nil {
+				issuerID = issuerObj.IssuerID
+				break
+			}
+			log.Printf("Collision on issuer %v, retrying", issuerObj)
+			time.Sleep(backoff.Duration())
+		}
+
+		if issuerID == 0 {
+			return 0, fmt.Errorf("failed to obtain an issuerID for aki=%s", aki)
+		}
+
+		b.Db.IssuersLock.Lock()
+		b.Db.KnownIssuers[aki] = issuerID
+		b.Db.IssuersLock.Unlock()
+	}
+
+	b.issuerCache.Add(aki, issuerID)
+	return issuerID, nil
+}
+
+// placeholders returns a "?, ?, ..." fragment with n placeholders, for
+// building IN (...) clauses over a slice of args.
+func placeholders(n int) string {
+	ph := make([]string, n)
+	for i := range ph {
+		ph[i] = "?"
+	}
+	return strings.Join(ph, ", ")
+}
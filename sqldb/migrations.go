@@ -0,0 +1,74 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// applyMigrations runs every *.up.sql file found under
+// migrations/<dialect>/, in filename order, recording each one in a
+// schema_migrations table so re-runs are idempotent. This is the mechanism
+// by which every Store gets its schema, the MySQL EntriesDatabase included,
+// since gorp's AddTableWithName only registers struct metadata.
+func applyMigrations(db *sql.DB, dialect, dir string, checkQuery, insertQuery string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		filename VARCHAR(255) PRIMARY KEY
+	)`)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_migrations table: %s", err)
+	}
+
+	migrationsDir := filepath.Join(dir, dialect)
+	files, err := ioutil.ReadDir(migrationsDir)
+	if err != nil {
+		return fmt.Errorf("unable to list migrations in %s: %s", migrationsDir, err)
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".up.sql") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var alreadyApplied int
+		if err := db.QueryRow(checkQuery, name).Scan(&alreadyApplied); err != nil {
+			return fmt.Errorf("unable to check schema_migrations for %s: %s", name, err)
+		}
+		if alreadyApplied > 0 {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(migrationsDir, name))
+		if err != nil {
+			return fmt.Errorf("unable to read migration %s: %s", name, err)
+		}
+
+		// The MySQL driver rejects several statements in one Exec unless the
+		// DSN sets multiStatements, so each statement is run on its own.
+		for _, stmt := range strings.Split(string(contents), ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("unable to apply migration %s: %s", name, err)
+			}
+		}
+
+		if _, err := db.Exec(insertQuery, name); err != nil {
+			return fmt.Errorf("unable to record migration %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"time"
+)
+
+// NetscanClaim is a single leased netscanqueue row returned by ClaimBatch:
+// the name to resolve plus its internal NameID, so the caller can Ack it by
+// ID alone once the resolution is durably recorded.
+type NetscanClaim struct {
+	NameID uint64 `db:"nameID"`
+	Name   string `db:"name"`
+}
+
+// ClaimBatch leases up to n unleased (or lease-expired) netscanqueue rows to
+// workerID for leaseDuration and returns the hostnames to resolve. A claimed
+// row stays invisible to other ClaimBatch callers until AckResolution
+// deletes it or its lease expires (ReapExpiredLeases also clears expired
+// leases), so a crash mid-resolution only delays a name, never loses it.
+func (edb *EntriesDatabase) ClaimBatch(workerID string, n int, leaseDuration time.Duration) ([]NetscanClaim, error) {
+	txn, err := edb.DbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var claims []NetscanClaim
+	_, err = txn.Select(&claims,
+		`SELECT q.nameID AS nameID, f.name AS name FROM netscanqueue AS q
+		NATURAL JOIN fqdn AS f
+		WHERE q.leaseExpires IS NULL OR q.leaseExpires < ?
+		ORDER BY q.time ASC
+		LIMIT ?
+		FOR UPDATE`,
+		time.Now(), n)
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+
+	if len(claims) == 0 {
+		return claims, txn.Commit()
+	}
+
+	expires := time.Now().Add(leaseDuration)
+	for _, c := range claims {
+		_, err = txn.Exec(
+			`UPDATE netscanqueue SET leasedBy = ?, leaseExpires = ? WHERE nameID = ?`,
+			workerID, expires, c.NameID)
+		if err != nil {
+			txn.Rollback()
+			return nil, err
+		}
+	}
+
+	return claims, txn.Commit()
+}
+
+// AckResolution deletes nameID's netscanqueue row, acknowledging that its
+// resolution was durably recorded. Unlike the lease taken by ClaimBatch,
+// this is the only thing that permanently removes a row from the queue.
+func (edb *EntriesDatabase) AckResolution(nameId uint64) error {
+	obj := &NetscanQueue{
+		NameID: nameId,
+	}
+	_, err := edb.DbMap.Delete(obj)
+	return err
+}
+
+// ReapExpiredLeases clears leasedBy/leaseExpires on any netscanqueue row
+// whose lease expired before now, making it eligible for ClaimBatch again.
+// Intended to be run periodically from a background goroutine so that a
+// crashed or killed worker's in-flight names are not lost forever.
+func (edb *EntriesDatabase) ReapExpiredLeases() (int64, error) {
+	result, err := edb.DbMap.Exec(
+		`UPDATE netscanqueue SET leasedBy = NULL, leaseExpires = NULL WHERE leaseExpires < ?`,
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package query exposes an ingested ct-sql corpus over an HTTP+JSON API
+// modeled on crt.sh's search semantics, so existing crt.sh-style tooling
+// (certgraph-style crawlers, etc.) can treat a ct-sql database as a
+// self-hosted crt.sh replacement.
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jcjones/ct-sql/sqldb"
+)
+
+// Server serves the crt.sh-compatible read API over Db.
+type Server struct {
+	Db *sqldb.EntriesDatabase
+}
+
+func NewServer(db *sqldb.EntriesDatabase) *Server {
+	return &Server{Db: db}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/certs", s.handleCerts)
+	mux.HandleFunc("/issuers/", s.handleIssuerCerts)
+	return mux
+}
+
+// handleCerts implements:
+//   GET /certs?domain=example.com&include_subdomains=1&include_expired=0
+//   GET /certs?serial=...
+//   GET /certs?sha256=...
+// Any of the above may be combined with issuer_cn to further narrow the
+// match to a single issuer.
+func (s *Server) handleCerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter := sqldb.CertQueryFilter{
+		Domain:            q.Get("domain"),
+		Serial:            q.Get("serial"),
+		SHA256:            q.Get("sha256"),
+		IssuerCN:          q.Get("issuer_cn"),
+		IncludeSubdomains: boolParam(q, "include_subdomains"),
+		IncludeExpired:    boolParam(q, "include_expired"),
+	}
+
+	if filter.Domain == "" && filter.Serial == "" && filter.SHA256 == "" {
+		writeError(w, http.StatusBadRequest, "one of domain, serial, or sha256 is required")
+		return
+	}
+
+	results, err := s.Db.QueryCerts(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResults(w, r, results)
+}
+
+// handleIssuerCerts implements GET /issuers/{id}/certs.
+func (s *Server) handleIssuerCerts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "certs" {
+		http.NotFound(w, r)
+		return
+	}
+
+	issuerID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "issuer id must be numeric")
+		return
+	}
+
+	results, err := s.Db.QueryByIssuer(issuerID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResults(w, r, results)
+}
+
+// writeResults renders results as a JSON array by default, or as
+// line-delimited NDJSON (one object per line, written as it's encoded rather
+// than wrapped in a single top-level array) when the client asks via
+// Accept: application/x-ndjson. results is still the fully materialized
+// slice QueryCerts/QueryByIssuer returned -- neither format avoids buffering
+// the result set in memory server-side, since the underlying queries use
+// DbMap.Select rather than a streamed *sql.Rows cursor. NDJSON only saves a
+// client from having to buffer the whole response before it can start
+// parsing lines.
+func writeResults(w http.ResponseWriter, r *http.Request, results []sqldb.CertQueryResult) {
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, result := range results {
+			if err := enc.Encode(result); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func boolParam(q map[string][]string, name string) bool {
+	vals, ok := q[name]
+	if !ok || len(vals) == 0 {
+		return false
+	}
+	switch vals[0] {
+	case "1", "true", "yes":
+		return true
+	default:
+		return false
+	}
+}
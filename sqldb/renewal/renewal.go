@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package renewal turns the ingest-only unexpired_certificate table into an
+// actively maintained cert inventory: it surfaces certificates approaching
+// expiry, queues them for renewal, and, for domains the operator controls,
+// drives renewal via golang.org/x/crypto/acme/autocert.
+package renewal
+
+import (
+	"crypto/tls"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/certificate-transparency/go"
+	"github.com/jcjones/ct-sql/sqldb"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var expiringByDaysRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ct_sql_renewal_certs_expiring",
+	Help: "Count of unexpired certificates, bucketed by days remaining and issuer.",
+}, []string{"days_remaining_bucket", "issuer_id"})
+
+func init() {
+	prometheus.MustRegister(expiringByDaysRemaining)
+}
+
+// Watcher periodically scans unexpired_certificate for certificates
+// approaching expiry, records Prometheus metrics, and queues renewal
+// candidates. AutocertConfig is accepted and stored for callers that want
+// to drive AutocertRenewer.Renew themselves once a candidate is queued;
+// scanOnce does not call it directly (see AutocertRenewer.Renew).
+type Watcher struct {
+	Db             *sqldb.EntriesDatabase
+	Window         time.Duration
+	PollInterval   time.Duration
+	AutocertConfig *AutocertRenewer // nil disables automatic ACME renewal
+	LogID          int
+}
+
+// AutocertRenewer drives renewal for domains the operator controls via
+// autocert, storing the replacement certificate back into the same
+// ingestion pipeline as any other CT-observed certificate.
+type AutocertRenewer struct {
+	Manager *autocert.Manager
+	Db      *sqldb.EntriesDatabase
+	LogID   int
+}
+
+// Renew obtains a fresh certificate for domain via ACME and inserts it back
+// into the pipeline through the same path a newly-observed CT log entry
+// would take.
+//
+// scanOnce does not call this yet: UnexpiredCertificate, what
+// CertsExpiringWithin scans, carries only certID/issuerID/validity dates,
+// not the domain(s) a candidate covers, so there is no domain to pass here
+// without a further join out to fqdn that hasn't been added. Driving ACME
+// renewal automatically also means deciding, per candidate, whether its
+// domain is one AutocertConfig's operator actually controls -- autocert's
+// HostPolicy is the natural place for that, but nothing here calls into it
+// yet either. Until both exist, Renew is reachable only by a caller driving
+// it directly.
+func (r *AutocertRenewer) Renew(domain string) error {
+	hello := &tls.ClientHelloInfo{ServerName: domain}
+	cert, err := r.Manager.GetCertificate(hello)
+	if err != nil {
+		return err
+	}
+
+	entry := &ct.LogEntry{}
+	entry.Leaf.TimestampedEntry.EntryType = ct.X509LogEntryType
+	entry.Leaf.TimestampedEntry.X509Entry = cert.Certificate[0]
+
+	return r.Db.InsertCTEntry(entry, r.LogID)
+}
+
+// Run starts the background scan loop. It blocks until stop is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.scanOnce()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *Watcher) scanOnce() {
+	candidates, err := w.Db.CertsExpiringWithin(w.Window)
+	if err != nil {
+		log.Printf("renewal: unable to list expiring certificates: %s", err)
+		return
+	}
+
+	// A bucket/issuer pair with zero candidates this scan must still read
+	// as zero, not silently keep whatever non-zero value the previous scan
+	// last Set it to.
+	expiringByDaysRemaining.Reset()
+
+	buckets := make(map[string]map[string]int)
+	for _, cert := range candidates {
+		notAfter, err := time.Parse("2006-01-02", cert.NotAfter)
+		if err != nil {
+			continue
+		}
+
+		bucket := daysRemainingBucket(time.Until(notAfter))
+		issuer := strconv.Itoa(cert.IssuerID)
+		if buckets[bucket] == nil {
+			buckets[bucket] = make(map[string]int)
+		}
+		buckets[bucket][issuer]++
+
+		if err := w.Db.QueueForRenewal(cert.CertID); err != nil {
+			log.Printf("renewal: unable to queue certID %d: %s", cert.CertID, err)
+		}
+	}
+
+	for bucket, byIssuer := range buckets {
+		for issuer, count := range byIssuer {
+			expiringByDaysRemaining.WithLabelValues(bucket, issuer).Set(float64(count))
+		}
+	}
+}
+
+func daysRemainingBucket(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	switch {
+	case d <= 0:
+		return "expired"
+	case days <= 7:
+		return "0-7"
+	case days <= 30:
+		return "8-30"
+	case days <= 90:
+		return "31-90"
+	default:
+		return "90+"
+	}
+}
@@ -0,0 +1,363 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dbInsertLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "ct_sql_netscan_db_insert_seconds",
+	Help:    "Latency of a ResolutionWriter batch INSERT, labeled by table.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"table"})
+
+var dbInsertErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ct_sql_netscan_db_insert_errors_total",
+	Help: "Count of ResolutionWriter batch INSERT failures, labeled by table.",
+}, []string{"table"})
+
+func init() {
+	prometheus.MustRegister(dbInsertLatency)
+	prometheus.MustRegister(dbInsertErrors)
+}
+
+// pendingName, pendingPlace, pendingASN, and pendingMetadata pair a row
+// queued for a future flush with a done channel that receives the outcome
+// of whatever flush eventually writes it, mirroring batch.go's
+// pendingCert/preparedCert split. PutName and friends return done as soon
+// as the row is buffered, and a caller that only acks after receiving from
+// done is acking a durably committed row, not a row that might still be
+// sitting in an unflushed channel.
+type pendingName struct {
+	row  *ResolvedName
+	done chan error
+}
+
+type pendingPlace struct {
+	row  *ResolvedPlace
+	done chan error
+}
+
+type pendingASN struct {
+	row  *ResolvedASN
+	done chan error
+}
+
+type pendingMetadata struct {
+	row  *ResolutionMetadata
+	done chan error
+}
+
+// ResolutionWriter buffers ResolvedName/ResolvedPlace/ResolvedASN/
+// ResolutionMetadata rows pushed from resolveWorker goroutines and flushes
+// them as multi-row INSERTs, either once BatchSize rows have accumulated or
+// every FlushInterval, whichever comes first. This replaces each worker
+// calling InsertResolvedName/InsertResolvedPlace synchronously in the hot
+// loop, which was the throughput ceiling under many workers.
+type ResolutionWriter struct {
+	Db            *EntriesDatabase
+	BatchSize     int
+	FlushInterval time.Duration
+
+	namesCh    chan *pendingName
+	placesCh   chan *pendingPlace
+	asnCh      chan *pendingASN
+	metadataCh chan *pendingMetadata
+
+	stmtCache sync.Map // batch row count -> *sql.Stmt, per query shape
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewResolutionWriter returns a ResolutionWriter ready to Start.
+func NewResolutionWriter(db *EntriesDatabase, batchSize int, flushInterval time.Duration) *ResolutionWriter {
+	return &ResolutionWriter{
+		Db:            db,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		namesCh:       make(chan *pendingName, batchSize),
+		placesCh:      make(chan *pendingPlace, batchSize),
+		asnCh:         make(chan *pendingASN, batchSize),
+		metadataCh:    make(chan *pendingMetadata, batchSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start launches the background flush loop.
+func (w *ResolutionWriter) Start() {
+	go w.run()
+}
+
+// Stop drains and flushes whatever is buffered, including rows still
+// sitting in namesCh/placesCh/asnCh/metadataCh that run's select loop
+// hasn't pulled off yet, and waits for the flush loop to exit. Callers must
+// stop calling PutName/PutPlace/PutASN/PutMetadata before calling Stop, or
+// those sends can race the drain and be left unflushed.
+func (w *ResolutionWriter) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// PutName queues a ResolvedName row for a future flush and returns a channel
+// that receives the error (nil on success) from the flush that actually
+// writes it, once that flush commits or fails.
+func (w *ResolutionWriter) PutName(nameID uint64, address string, isIPv6 bool) <-chan error {
+	p := &pendingName{
+		row:  &ResolvedName{NameID: nameID, Time: time.Now(), Address: address, IsIPv6: isIPv6},
+		done: make(chan error, 1),
+	}
+	w.namesCh <- p
+	return p.done
+}
+
+// PutPlace queues a ResolvedPlace row for a future flush and returns a
+// channel that receives the error (nil on success) from the flush that
+// actually writes it, once that flush commits or fails.
+func (w *ResolutionWriter) PutPlace(nameID uint64, city, country, continent string) <-chan error {
+	p := &pendingPlace{
+		row:  &ResolvedPlace{NameID: nameID, Time: time.Now(), City: city, Country: country, Continent: continent},
+		done: make(chan error, 1),
+	}
+	w.placesCh <- p
+	return p.done
+}
+
+// PutASN queues a ResolvedASN row for a future flush and returns a channel
+// that receives the error (nil on success) from the flush that actually
+// writes it, once that flush commits or fails.
+func (w *ResolutionWriter) PutASN(nameID uint64, address string, asn uint, org, network string) <-chan error {
+	p := &pendingASN{
+		row:  &ResolvedASN{NameID: nameID, Time: time.Now(), Address: address, ASN: asn, Org: org, Network: network},
+		done: make(chan error, 1),
+	}
+	w.asnCh <- p
+	return p.done
+}
+
+// PutMetadata queues a ResolutionMetadata row for a future flush and
+// returns a channel that receives the error (nil on success) from the
+// flush that actually writes it, once that flush commits or fails.
+func (w *ResolutionWriter) PutMetadata(nameID uint64, resolverName string, rtt time.Duration) <-chan error {
+	p := &pendingMetadata{
+		row:  &ResolutionMetadata{NameID: nameID, Time: time.Now(), Resolver: resolverName, RTTMicros: rtt.Microseconds()},
+		done: make(chan error, 1),
+	}
+	w.metadataCh <- p
+	return p.done
+}
+
+func (w *ResolutionWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	var names []*pendingName
+	var places []*pendingPlace
+	var asns []*pendingASN
+	var metas []*pendingMetadata
+
+	flush := func() {
+		if len(names) > 0 {
+			w.flushNames(names)
+			names = nil
+		}
+		if len(places) > 0 {
+			w.flushPlaces(places)
+			places = nil
+		}
+		if len(asns) > 0 {
+			w.flushASNs(asns)
+			asns = nil
+		}
+		if len(metas) > 0 {
+			w.flushMetadata(metas)
+			metas = nil
+		}
+	}
+
+	// drainChannels pulls every row still sitting in namesCh/placesCh/
+	// asnCh/metadataCh into the local slices without blocking, so Stop
+	// doesn't lose rows a caller's Put already returned from (and is
+	// waiting on the done channel of) but that this loop hadn't read yet.
+	drainChannels := func() {
+		for {
+			select {
+			case n := <-w.namesCh:
+				names = append(names, n)
+				continue
+			case p := <-w.placesCh:
+				places = append(places, p)
+				continue
+			case a := <-w.asnCh:
+				asns = append(asns, a)
+				continue
+			case m := <-w.metadataCh:
+				metas = append(metas, m)
+				continue
+			default:
+			}
+			return
+		}
+	}
+
+	for {
+		select {
+		case n := <-w.namesCh:
+			names = append(names, n)
+			if len(names) >= w.BatchSize {
+				w.flushNames(names)
+				names = nil
+			}
+		case p := <-w.placesCh:
+			places = append(places, p)
+			if len(places) >= w.BatchSize {
+				w.flushPlaces(places)
+				places = nil
+			}
+		case a := <-w.asnCh:
+			asns = append(asns, a)
+			if len(asns) >= w.BatchSize {
+				w.flushASNs(asns)
+				asns = nil
+			}
+		case m := <-w.metadataCh:
+			metas = append(metas, m)
+			if len(metas) >= w.BatchSize {
+				w.flushMetadata(metas)
+				metas = nil
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.stop:
+			drainChannels()
+			flush()
+			return
+		}
+	}
+}
+
+// preparedStmt returns a cached *sql.Stmt for a multi-row INSERT of
+// rowCount rows into table with the given per-row columns, preparing (and
+// caching) it on first use so repeated full-size batches don't re-prepare.
+func (w *ResolutionWriter) preparedStmt(table string, columns []string, rowCount int) (*sql.Stmt, error) {
+	cacheKey := fmt.Sprintf("%s:%d", table, rowCount)
+	if cached, ok := w.stmtCache.Load(cacheKey); ok {
+		return cached.(*sql.Stmt), nil
+	}
+
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+		table, strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat(placeholder+",", rowCount), ","))
+
+	stmt, err := w.Db.DbMap.Db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	w.stmtCache.Store(cacheKey, stmt)
+	return stmt, nil
+}
+
+func (w *ResolutionWriter) flushNames(rows []*pendingName) {
+	args := make([]interface{}, 0, len(rows)*4)
+	for _, r := range rows {
+		args = append(args, r.row.NameID, r.row.Time, r.row.Address, r.row.IsIPv6)
+	}
+	err := w.execBatch("resolvedname", []string{"nameID", "time", "ipaddr", "isIPv6"}, len(rows), args)
+	for _, r := range rows {
+		r.done <- err
+	}
+}
+
+func (w *ResolutionWriter) flushPlaces(rows []*pendingPlace) {
+	args := make([]interface{}, 0, len(rows)*5)
+	for _, r := range rows {
+		args = append(args, r.row.NameID, r.row.Time, r.row.City, r.row.Country, r.row.Continent)
+	}
+	err := w.execBatch("resolvedplace", []string{"nameID", "time", "city", "country", "continent"}, len(rows), args)
+	for _, r := range rows {
+		r.done <- err
+	}
+}
+
+func (w *ResolutionWriter) flushASNs(rows []*pendingASN) {
+	args := make([]interface{}, 0, len(rows)*6)
+	for _, r := range rows {
+		args = append(args, r.row.NameID, r.row.Time, r.row.Address, r.row.ASN, r.row.Org, r.row.Network)
+	}
+	err := w.execBatch("resolvedasn", []string{"nameID", "time", "ipaddr", "asn", "org", "network"}, len(rows), args)
+	for _, r := range rows {
+		r.done <- err
+	}
+}
+
+func (w *ResolutionWriter) flushMetadata(rows []*pendingMetadata) {
+	args := make([]interface{}, 0, len(rows)*4)
+	for _, r := range rows {
+		args = append(args, r.row.NameID, r.row.Time, r.row.Resolver, r.row.RTTMicros)
+	}
+	err := w.execBatch("resolution_metadata", []string{"nameID", "time", "resolver", "rttMicros"}, len(rows), args)
+	for _, r := range rows {
+		r.done <- err
+	}
+}
+
+// execBatch runs the cached prepared statement for table inside its own
+// transaction, so the multi-row INSERT actually commits as the single
+// transaction flush is documented to be, rather than autocommitting a lone
+// statement straight against the pool. Prepare, exec, and commit failures
+// are all logged, counted in dbInsertErrors, and returned so the caller can
+// propagate them to every row's done channel instead of silently dropping
+// rows that a caller may already be treating as durably written.
+func (w *ResolutionWriter) execBatch(table string, columns []string, rowCount int, args []interface{}) error {
+	defer observeInsertLatency(table, time.Now())
+
+	stmt, err := w.preparedStmt(table, columns, rowCount)
+	if err != nil {
+		log.Printf("ResolutionWriter: unable to prepare batch insert into %s: %s", table, err)
+		dbInsertErrors.WithLabelValues(table).Inc()
+		return err
+	}
+
+	tx, err := w.Db.DbMap.Db.Begin()
+	if err != nil {
+		log.Printf("ResolutionWriter: unable to begin transaction for %s: %s", table, err)
+		dbInsertErrors.WithLabelValues(table).Inc()
+		return err
+	}
+
+	if _, err := tx.Stmt(stmt).Exec(args...); err != nil {
+		tx.Rollback()
+		log.Printf("ResolutionWriter: batch insert into %s failed: %s", table, err)
+		dbInsertErrors.WithLabelValues(table).Inc()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("ResolutionWriter: unable to commit batch insert into %s: %s", table, err)
+		dbInsertErrors.WithLabelValues(table).Inc()
+		return err
+	}
+
+	return nil
+}
+
+// observeInsertLatency records the elapsed time since start against table's
+// dbInsertLatency bucket. Deferred at the top of execBatch so the
+// observation covers prepare, exec and commit, including any lock wait.
+func observeInsertLatency(table string, start time.Time) {
+	dbInsertLatency.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
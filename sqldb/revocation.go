@@ -0,0 +1,214 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency/go/x509"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPWorker fetches and stores OCSP responses for certificates that carry
+// an OCSP responder URL (cert.OCSPServer). It is intentionally simple:
+// callers are expected to drive it from whatever queueing mechanism feeds
+// insertCertificate today (e.g. once per newly-inserted cert).
+type OCSPWorker struct {
+	Db     *EntriesDatabase
+	Client *http.Client
+}
+
+func NewOCSPWorker(db *EntriesDatabase) *OCSPWorker {
+	return &OCSPWorker{
+		Db:     db,
+		Client: http.DefaultClient,
+	}
+}
+
+// FetchAndStore issues an OCSP request for cert (signed by issuer) and
+// records the result against certID. The cert's first OCSPServer entry is
+// used as the responder URL.
+func (w *OCSPWorker) FetchAndStore(certID uint64, cert *x509.Certificate, issuer *x509.Certificate) error {
+	if len(cert.OCSPServer) == 0 {
+		return fmt.Errorf("certID %d has no OCSPServer entries", certID)
+	}
+	responderURL := cert.OCSPServer[0]
+
+	// golang.org/x/crypto/ocsp works with stdlib crypto/x509.Certificate,
+	// not this package's certificate-transparency/go/x509.Certificate, so
+	// re-parse the raw DER before handing the certs to it.
+	stdCert, err := stdx509.ParseCertificate(cert.Raw)
+	if err != nil {
+		return fmt.Errorf("unable to re-parse certID %d for OCSP: %s", certID, err)
+	}
+	stdIssuer, err := stdx509.ParseCertificate(issuer.Raw)
+	if err != nil {
+		return fmt.Errorf("unable to re-parse issuer of certID %d for OCSP: %s", certID, err)
+	}
+
+	reqBytes, err := ocsp.CreateRequest(stdCert, stdIssuer, nil)
+	if err != nil {
+		return fmt.Errorf("unable to build OCSP request for certID %d: %s", certID, err)
+	}
+
+	httpReq, err := http.NewRequest("POST", responderURL, strings.NewReader(string(reqBytes)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := w.Client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("unable to fetch OCSP response from %s: %s", responderURL, err)
+	}
+	defer httpResp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(respBytes, stdCert, stdIssuer)
+	if err != nil {
+		return fmt.Errorf("unable to parse OCSP response from %s: %s", responderURL, err)
+	}
+
+	status := &CertificateStatus{
+		CertID:           certID,
+		LastOCSPResponse: respBytes,
+		LastOCSPUpdate:   time.Now(),
+		OCSPResponderURL: responderURL,
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		status.Status = "good"
+	case ocsp.Revoked:
+		status.Status = "revoked"
+		status.RevokedAt = resp.RevokedAt
+		status.RevocationReason = revocationReasonString(resp.RevocationReason)
+	default:
+		status.Status = "unknown"
+	}
+
+	return w.Db.UpsertCertificateStatus(status)
+}
+
+// CRLFetcher downloads CRLs referenced by a certificate's
+// CRLDistributionPoints and bulk-marks the matching certificates revoked.
+type CRLFetcher struct {
+	Db     *EntriesDatabase
+	Client *http.Client
+}
+
+func NewCRLFetcher(db *EntriesDatabase) *CRLFetcher {
+	return &CRLFetcher{
+		Db:     db,
+		Client: http.DefaultClient,
+	}
+}
+
+// FetchAndApply downloads every CRL referenced by cert's
+// CRLDistributionPoints, and for every revoked serial in those CRLs that
+// corresponds to a certID from issuerID, calls MarkRevoked.
+func (f *CRLFetcher) FetchAndApply(issuerID int, cert *x509.Certificate) error {
+	for _, url := range cert.CRLDistributionPoints {
+		if err := f.fetchOne(issuerID, url); err != nil {
+			log.Printf("CRLFetcher: unable to process CRL %s: %s", url, err)
+		}
+	}
+	return nil
+}
+
+func (f *CRLFetcher) fetchOne(issuerID int, url string) error {
+	resp, err := f.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	der, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		return fmt.Errorf("unable to parse CRL from %s: %s", url, err)
+	}
+
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		serial := fmt.Sprintf("%036x", revoked.SerialNumber)
+
+		var certID uint64
+		err := f.Db.DbMap.SelectOne(&certID,
+			"SELECT certID FROM certificate WHERE serial = ? AND issuerID = ?", serial, issuerID)
+		if err != nil {
+			// Not a certificate we've ingested; nothing to do.
+			continue
+		}
+
+		reason := crlEntryReason(revoked)
+		if err := f.Db.MarkRevoked(certID, reason, revoked.RevocationTime); err != nil {
+			log.Printf("CRLFetcher: unable to mark certID %d revoked: %s", certID, err)
+		}
+	}
+	return nil
+}
+
+// crlReasonOID is the CRL entry extension id-ce-cRLReason (RFC 5280 §5.3.1).
+var crlReasonOID = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// crlEntryReason extracts the revocation reason from a CRL entry's
+// extensions. The enumerated values defined by RFC 5280 line up with the
+// ocsp package's reason constants, so the decoded code can be fed straight
+// into revocationReasonString.
+func crlEntryReason(revoked pkix.RevokedCertificate) string {
+	for _, ext := range revoked.Extensions {
+		if !ext.Id.Equal(crlReasonOID) {
+			continue
+		}
+		var reasonCode asn1.Enumerated
+		if _, err := asn1.Unmarshal(ext.Value, &reasonCode); err == nil {
+			return revocationReasonString(int(reasonCode))
+		}
+	}
+	return "unspecified"
+}
+
+func revocationReasonString(reason int) string {
+	switch reason {
+	case ocsp.Unspecified:
+		return "unspecified"
+	case ocsp.KeyCompromise:
+		return "keyCompromise"
+	case ocsp.CACompromise:
+		return "cACompromise"
+	case ocsp.AffiliationChanged:
+		return "affiliationChanged"
+	case ocsp.Superseded:
+		return "superseded"
+	case ocsp.CessationOfOperation:
+		return "cessationOfOperation"
+	case ocsp.CertificateHold:
+		return "certificateHold"
+	case ocsp.RemoveFromCRL:
+		return "removeFromCRL"
+	case ocsp.PrivilegeWithdrawn:
+		return "privilegeWithdrawn"
+	case ocsp.AACompromise:
+		return "aACompromise"
+	default:
+		return "unknown"
+	}
+}
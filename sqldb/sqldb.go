@@ -7,6 +7,7 @@
 package sqldb
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -32,6 +33,7 @@ type Certificate struct {
 	Subject   string    `db:"subject"`                           // The Subject field of this cert
 	NotBefore time.Time `db:"notBefore"`                         // Date before which this cert should be considered invalid
 	NotAfter  time.Time `db:"notAfter"`                          // Date after which this cert should be considered invalid
+	SHA256    string    `db:"sha256"`                            // Hex-encoded sha256.Sum256(cert.Raw), unique across all certs
 }
 
 type UnexpiredCertificate struct {
@@ -92,6 +94,16 @@ type ResolvedName struct {
 	NameID  uint64    `db:"nameID"` // Internal Name Identifier (FK to Subject Name)
 	Time    time.Time `db:"time"`   // Date when this resolution was performed
 	Address string    `db:"ipaddr"` // IP address resolved at this name
+	IsIPv6  bool      `db:"isIPv6"` // True if Address is an IPv6 literal
+}
+
+type ResolvedASN struct {
+	NameID  uint64    `db:"nameID"`  // Internal Name Identifier (FK to Subject Name)
+	Time    time.Time `db:"time"`    // Date when this resolution was performed
+	Address string    `db:"ipaddr"`  // The IP address this ASN record describes
+	ASN     uint      `db:"asn"`     // Autonomous System Number
+	Org     string    `db:"org"`     // AS organization name
+	Network string    `db:"network"` // The announced CIDR network containing Address
 }
 
 type ResolvedPlace struct {
@@ -102,9 +114,38 @@ type ResolvedPlace struct {
 	Continent string    `db:"continent"` // Geo: Continent name
 }
 
+type ResolutionMetadata struct {
+	NameID    uint64    `db:"nameID"`    // Internal Name Identifier (FK to Subject Name)
+	Time      time.Time `db:"time"`      // Date when this resolution was performed
+	Resolver  string    `db:"resolver"`  // Which server/mode answered, e.g. "stdlib" or "8.8.8.8:53"
+	RTTMicros int64     `db:"rttMicros"` // Round-trip time for the lookup, in microseconds
+}
+
 type NetscanQueue struct {
-	NameID    uint64    `db:"nameID, primarykey"` // Internal Name Identifier (FK to Subject Name)
-	TimeAdded time.Time `db:"time"`               // Date when this resolution was performed
+	NameID       uint64     `db:"nameID, primarykey"` // Internal Name Identifier (FK to Subject Name)
+	TimeAdded    time.Time  `db:"time"`                // Date when this resolution was performed
+	LeasedBy     *string    `db:"leasedBy"`             // Worker ID holding the current lease, if any
+	LeaseExpires *time.Time `db:"leaseExpires"`         // When the current lease expires, if any
+}
+
+type CertificateStatus struct {
+	CertID           uint64    `db:"certID, primarykey"` // Internal Cert Identifier (FK to Certificate)
+	Status           string    `db:"status"`             // "good", "revoked", or "unknown"
+	RevokedAt        time.Time `db:"revokedAt"`          // Date the cert was revoked, if known
+	RevocationReason string    `db:"revocationReason"`   // CRLReason string, e.g. "keyCompromise"
+	LastOCSPResponse []byte    `db:"lastOCSPResponse"`   // Raw DER of the most recent OCSP response
+	LastOCSPUpdate   time.Time `db:"lastOCSPUpdate"`     // Date the OCSP response was last fetched
+	OCSPResponderURL string    `db:"ocspResponderURL"`   // The responder URL taken from the cert's AIA
+}
+
+// RenewalQueue tracks certificates that CertsExpiringWithin has flagged as
+// renewal candidates, with backoff/retry columns modeled on NetscanQueue.
+type RenewalQueue struct {
+	CertID      uint64    `db:"certID, primarykey"` // Internal Cert Identifier (FK to Certificate)
+	TimeAdded   time.Time `db:"timeAdded"`          // When this cert was queued for renewal
+	Attempts    int       `db:"attempts"`           // Number of renewal attempts so far
+	NextAttempt time.Time `db:"nextAttempt"`        // Earliest time the next attempt may run
+	LastError   string    `db:"lastError"`          // The error from the most recent failed attempt, if any
 }
 
 type FirefoxPageloadIsTLS struct {
@@ -133,6 +174,13 @@ type EntriesDatabase struct {
 	EarliestDateFilter  time.Time
 	CorrelateLogEntries bool
 	LogExpiredEntries   bool
+
+	// Batcher, if set, makes InsertCTEntry accumulate certificates into
+	// batched, single-transaction writes instead of one transaction per
+	// cert. It is not consulted when CorrelateLogEntries is set, since
+	// BatchInserter doesn't yet know how to record per-entry log
+	// correlation.
+	Batcher *BatchInserter
 }
 
 // Taken from Boulder
@@ -192,9 +240,13 @@ func (edb *EntriesDatabase) InitTables() error {
 	edb.DbMap.AddTableWithName(CertToRegisteredDomain{}, "cert_registereddomain")
 	edb.DbMap.AddTableWithName(ResolvedName{}, "resolvedname")
 	edb.DbMap.AddTableWithName(ResolvedPlace{}, "resolvedplace")
+	edb.DbMap.AddTableWithName(ResolvedASN{}, "resolvedasn")
+	edb.DbMap.AddTableWithName(ResolutionMetadata{}, "resolution_metadata")
 	edb.DbMap.AddTableWithName(NetscanQueue{}, "netscanqueue")
 	edb.DbMap.AddTableWithName(FirefoxPageloadIsTLS{}, "firefoxpageloadstls")
 	edb.DbMap.AddTableWithName(UnexpiredCertificate{}, "unexpired_certificate")
+	edb.DbMap.AddTableWithName(CertificateStatus{}, "certificate_status").SetKeys(false, "CertID")
+	edb.DbMap.AddTableWithName(RenewalQueue{}, "renewal_queue").SetKeys(false, "CertID")
 
 	edb.DbMap.AddTableWithName(RegisteredDomain{}, "registereddomain").SetKeys(true, "regdomID")
 	edb.DbMap.AddTableWithName(CertificateLog{}, "ctlog").SetKeys(true, "LogID")
@@ -202,10 +254,52 @@ func (edb *EntriesDatabase) InitTables() error {
 	edb.DbMap.AddTableWithName(FQDN{}, "fqdn").SetKeys(true, "NameID")
 	edb.DbMap.AddTableWithName(Issuer{}, "issuer").SetKeys(true, "IssuerID")
 
-	// All is well, no matter what.
+	// gorp's AddTableWithName above only registers struct metadata; it never
+	// issues DDL. Run the migrations/mysql/*.up.sql files through the same
+	// applyMigrations runner the Postgres and SQLite Stores use. Those files
+	// create only issuer, certificate and certificate_status and alter
+	// resolvedname and netscanqueue, so they do not provision an empty MySQL
+	// database on their own.
+	return applyMigrations(edb.DbMap.Db, "mysql", MigrationsDir,
+		"SELECT COUNT(*) FROM schema_migrations WHERE filename = ?",
+		"INSERT INTO schema_migrations (filename) VALUES (?)")
+}
+
+// CertsExpiringWithin returns every UnexpiredCertificate whose NotAfter falls
+// within d of now, for surfacing renewal candidates.
+func (edb *EntriesDatabase) CertsExpiringWithin(d time.Duration) ([]UnexpiredCertificate, error) {
+	var results []UnexpiredCertificate
+	deadline := time.Now().Add(d).Format("2006-01-02")
+	_, err := edb.DbMap.Select(&results,
+		"SELECT * FROM unexpired_certificate WHERE notAfter <= ?", deadline)
+	return results, err
+}
+
+// QueueForRenewal adds certID to the renewal queue, or leaves it untouched
+// if already queued.
+func (edb *EntriesDatabase) QueueForRenewal(certID uint64) error {
+	obj := &RenewalQueue{
+		CertID:    certID,
+		TimeAdded: time.Now(),
+	}
+	err := edb.DbMap.Insert(obj)
+	if errorIsNotDuplicate(err) {
+		return err
+	}
 	return nil
 }
 
+// GetCertificateByFingerprint looks up a certificate by its sha256 column,
+// the O(1) dedup key used in place of (serial, issuerID).
+func (edb *EntriesDatabase) GetCertificateByFingerprint(sha256Hex string) (*Certificate, error) {
+	var certObj Certificate
+	err := edb.DbMap.SelectOne(&certObj, "SELECT * FROM certificate WHERE sha256 = ?", sha256Hex)
+	if err != nil {
+		return nil, err
+	}
+	return &certObj, nil
+}
+
 func (edb *EntriesDatabase) GetLogState(url string) (*CertificateLog, error) {
 	var certLogObj CertificateLog
 
@@ -292,12 +386,19 @@ func (edb *EntriesDatabase) insertCertificate(cert *x509.Certificate) (*gorp.Tra
 	// Parse the serial number
 	serialNum := fmt.Sprintf("%036x", cert.SerialNumber)
 
+	// Fingerprint the raw DER so re-issued certs with colliding serials
+	// across misconfigured CAs are still deduplicated correctly, and
+	// cross-log dedup becomes an O(1) hash lookup instead of a
+	// (serial, issuerID) scan.
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+
 	certObj := &Certificate{
 		Serial:    serialNum,
 		IssuerID:  issuerID,
 		Subject:   cert.Subject.CommonName,
 		NotBefore: cert.NotBefore.UTC(),
 		NotAfter:  cert.NotAfter.UTC(),
+		SHA256:    fingerprint,
 	}
 
 	//
@@ -313,7 +414,7 @@ func (edb *EntriesDatabase) insertCertificate(cert *x509.Certificate) (*gorp.Tra
 		}
 
 		// Otherwise, it's a duplicate.
-		err = txn.SelectOne(&certId, "SELECT certID FROM certificate WHERE serial = ? AND issuerID = ?", serialNum, issuerID)
+		err = txn.SelectOne(&certId, "SELECT certID FROM certificate WHERE sha256 = ?", fingerprint)
 		if err != nil {
 			return txn, 0, fmt.Errorf("Unexpected error finding a certificate after getting an insertion error: %#v: %s", certObj, err)
 		}
@@ -348,7 +449,7 @@ func (edb *EntriesDatabase) insertCertificate(cert *x509.Certificate) (*gorp.Tra
 	// Insert the raw certificate, if not already there
 	//
 	if edb.FullCerts != nil {
-		err := edb.FullCerts.Store(certId, cert.Raw)
+		err := edb.FullCerts.StoreByFingerprint(certObj.SHA256, cert.Raw)
 		if err != nil {
 			return txn, certId, fmt.Errorf("DB error on raw certificate: %d: %s", certId, err)
 		}
@@ -577,6 +678,10 @@ func (edb *EntriesDatabase) InsertCTEntry(entry *ct.LogEntry, logID int) error {
 		return nil
 	}
 
+	if edb.Batcher != nil && !edb.CorrelateLogEntries {
+		return edb.Batcher.Add(cert)
+	}
+
 	backoff := &backoff.Backoff{
 		Jitter: true,
 	}
@@ -617,11 +722,24 @@ func (edb *EntriesDatabase) InsertCTEntry(entry *ct.LogEntry, logID int) error {
 	return err
 }
 
-func (edb *EntriesDatabase) InsertResolvedName(nameId uint64, address string) error {
+func (edb *EntriesDatabase) InsertResolvedName(nameId uint64, address string, isIPv6 bool) error {
 	obj := &ResolvedName{
 		NameID:  nameId,
 		Time:    time.Now(),
 		Address: address,
+		IsIPv6:  isIPv6,
+	}
+	return edb.DbMap.Insert(obj)
+}
+
+func (edb *EntriesDatabase) InsertResolvedASN(nameId uint64, address string, asn uint, org string, network string) error {
+	obj := &ResolvedASN{
+		NameID:  nameId,
+		Time:    time.Now(),
+		Address: address,
+		ASN:     asn,
+		Org:     org,
+		Network: network,
 	}
 	return edb.DbMap.Insert(obj)
 }
@@ -637,12 +755,187 @@ func (edb *EntriesDatabase) InsertResolvedPlace(nameId uint64, city string, coun
 	return edb.DbMap.Insert(obj)
 }
 
-func (edb *EntriesDatabase) UnqueueFromNetscan(nameId uint64) error {
-	obj := &NetscanQueue{
-		NameID: nameId,
+func (edb *EntriesDatabase) InsertResolutionMetadata(nameId uint64, resolverName string, rtt time.Duration) error {
+	obj := &ResolutionMetadata{
+		NameID:    nameId,
+		Time:      time.Now(),
+		Resolver:  resolverName,
+		RTTMicros: rtt.Microseconds(),
 	}
-	_, err := edb.DbMap.Delete(obj)
-	return err
+	return edb.DbMap.Insert(obj)
+}
+
+// UpsertCertificateStatus inserts a new CertificateStatus row, or updates the
+// existing one for certID if one is already present.
+func (edb *EntriesDatabase) UpsertCertificateStatus(status *CertificateStatus) error {
+	recordsUpdated, err := edb.DbMap.Update(status)
+	if err != nil {
+		return err
+	}
+	if recordsUpdated == 0 {
+		return edb.DbMap.Insert(status)
+	}
+	return nil
+}
+
+// GetCertificateStatus returns the CertificateStatus for certID, if any has
+// been recorded.
+func (edb *EntriesDatabase) GetCertificateStatus(certID uint64) (*CertificateStatus, error) {
+	var status CertificateStatus
+	err := edb.DbMap.SelectOne(&status, "SELECT * FROM certificate_status WHERE certID = ?", certID)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// MarkRevoked records certID as revoked as of when, for the given reason.
+// This is used both by the OCSP worker and by CRL-based bulk revocation.
+func (edb *EntriesDatabase) MarkRevoked(certID uint64, reason string, when time.Time) error {
+	status, err := edb.GetCertificateStatus(certID)
+	if err != nil {
+		status = &CertificateStatus{CertID: certID}
+	}
+	status.Status = "revoked"
+	status.RevokedAt = when
+	status.RevocationReason = reason
+	return edb.UpsertCertificateStatus(status)
+}
+
+// CertQueryResult is the typed row returned by QueryCerts and friends, joined
+// across fqdn/cert_fqdn/certificate/issuer so callers don't need to know the
+// underlying schema.
+type CertQueryResult struct {
+	CertID    uint64    `db:"certID"`
+	Serial    string    `db:"serial"`
+	Subject   string    `db:"subject"`
+	NotBefore time.Time `db:"notBefore"`
+	NotAfter  time.Time `db:"notAfter"`
+	IssuerID  int       `db:"issuerID"`
+	IssuerCN  string    `db:"issuerCN"`
+}
+
+// CertQueryFilter describes a crt.sh-style search: at most one of Domain,
+// Serial, or SHA256 should be set.
+type CertQueryFilter struct {
+	Domain            string
+	IncludeSubdomains bool
+	IncludeExpired    bool
+	Serial            string
+	IssuerCN          string
+	SHA256            string
+}
+
+// QueryCerts dispatches to the appropriate search based on which fields of
+// filter are populated, mirroring the parameters crt.sh's search accepts.
+func (edb *EntriesDatabase) QueryCerts(filter CertQueryFilter) ([]CertQueryResult, error) {
+	switch {
+	case filter.Domain != "":
+		return edb.QueryByDomain(filter.Domain, filter.IssuerCN, filter.IncludeSubdomains, filter.IncludeExpired)
+	case filter.Serial != "":
+		return edb.QueryBySerial(filter.Serial, filter.IssuerCN)
+	case filter.SHA256 != "":
+		return edb.QueryBySHA256(filter.SHA256, filter.IssuerCN)
+	default:
+		return nil, fmt.Errorf("CertQueryFilter must specify at least one of Domain, Serial, or SHA256")
+	}
+}
+
+// QueryByDomain returns every certificate for domain. When includeSubdomains
+// is set, this walks RegisteredDomain rather than doing an exact FQDN.Name
+// match. When includeExpired is unset, the same NotAfter > now() filter used
+// for unexpired_certificate on the ingest side is applied here too. issuerCN,
+// if non-empty, further restricts results to that issuer's common name.
+func (edb *EntriesDatabase) QueryByDomain(domain, issuerCN string, includeSubdomains, includeExpired bool) ([]CertQueryResult, error) {
+	var results []CertQueryResult
+
+	query := `
+		SELECT c.certID, c.serial, c.subject, c.notBefore, c.notAfter, c.issuerID, i.commonName AS issuerCN
+		FROM certificate c
+		JOIN issuer i ON i.issuerID = c.issuerID`
+
+	var args []interface{}
+	if includeSubdomains {
+		query += `
+		JOIN cert_registereddomain crd ON crd.certID = c.certID
+		JOIN registereddomain rd ON rd.regdomID = crd.regdomID
+		WHERE rd.domain = ?`
+		args = append(args, domain)
+	} else {
+		query += `
+		JOIN cert_fqdn cf ON cf.certID = c.certID
+		JOIN fqdn f ON f.nameID = cf.nameID
+		WHERE f.name = ?`
+		args = append(args, domain)
+	}
+
+	if !includeExpired {
+		query += " AND c.notAfter > ?"
+		args = append(args, time.Now())
+	}
+
+	if issuerCN != "" {
+		query += " AND i.commonName = ?"
+		args = append(args, issuerCN)
+	}
+
+	_, err := edb.DbMap.Select(&results, query, args...)
+	return results, err
+}
+
+// QueryBySerial returns the certificate(s) matching serial, across all
+// issuers (a serial number alone is not globally unique), unless issuerCN is
+// set, in which case it narrows the match to that issuer.
+func (edb *EntriesDatabase) QueryBySerial(serial, issuerCN string) ([]CertQueryResult, error) {
+	var results []CertQueryResult
+
+	query := `
+		SELECT c.certID, c.serial, c.subject, c.notBefore, c.notAfter, c.issuerID, i.commonName AS issuerCN
+		FROM certificate c
+		JOIN issuer i ON i.issuerID = c.issuerID
+		WHERE c.serial = ?`
+	args := []interface{}{serial}
+
+	if issuerCN != "" {
+		query += " AND i.commonName = ?"
+		args = append(args, issuerCN)
+	}
+
+	_, err := edb.DbMap.Select(&results, query, args...)
+	return results, err
+}
+
+// QueryBySHA256 returns the certificate matching the content-addressed
+// sha256 fingerprint (see Certificate.SHA256), unless issuerCN is set, in
+// which case it narrows the match to that issuer.
+func (edb *EntriesDatabase) QueryBySHA256(sha256, issuerCN string) ([]CertQueryResult, error) {
+	var results []CertQueryResult
+
+	query := `
+		SELECT c.certID, c.serial, c.subject, c.notBefore, c.notAfter, c.issuerID, i.commonName AS issuerCN
+		FROM certificate c
+		JOIN issuer i ON i.issuerID = c.issuerID
+		WHERE c.sha256 = ?`
+	args := []interface{}{sha256}
+
+	if issuerCN != "" {
+		query += " AND i.commonName = ?"
+		args = append(args, issuerCN)
+	}
+
+	_, err := edb.DbMap.Select(&results, query, args...)
+	return results, err
+}
+
+// QueryByIssuer returns every certificate issued by issuerID.
+func (edb *EntriesDatabase) QueryByIssuer(issuerID int) ([]CertQueryResult, error) {
+	var results []CertQueryResult
+	_, err := edb.DbMap.Select(&results, `
+		SELECT c.certID, c.serial, c.subject, c.notBefore, c.notAfter, c.issuerID, i.commonName AS issuerCN
+		FROM certificate c
+		JOIN issuer i ON i.issuerID = c.issuerID
+		WHERE c.issuerID = ?`, issuerID)
+	return results, err
 }
 
 func (edb *EntriesDatabase) InsertOrUpdatePageloadIsTLS(datestamp time.Time, isTLS int, count int) error {
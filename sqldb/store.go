@@ -0,0 +1,69 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AddCertificateParams is the typed parameter set for a single-certificate
+// insert, shared across backends so each dialect's SQL is generated from the
+// same inputs rather than assembled ad-hoc per call site.
+type AddCertificateParams struct {
+	Serial    string
+	IssuerID  int
+	Subject   string
+	NotBefore time.Time
+	NotAfter  time.Time
+	SHA256    string
+}
+
+// FindCertBySerialAndIssuerParams is the typed parameter set for looking up
+// a certificate by its (serial, issuerID) pair.
+type FindCertBySerialAndIssuerParams struct {
+	Serial   string
+	IssuerID int
+}
+
+// Store is the persistence boundary for the CT corpus. EntriesDatabase (the
+// original gorp/MySQL implementation) is one Store; OpenStore also knows how
+// to construct Postgres and SQLite backends from a DSN, so callers which only
+// need these operations don't need to depend on gorp or MySQL directly.
+type Store interface {
+	InitTables() error
+	InsertCertificate(params AddCertificateParams) (uint64, error)
+	FindCertBySerialAndIssuer(params FindCertBySerialAndIssuerParams) (uint64, error)
+	GetOrInsertName(name string) (uint64, error)
+	InsertRegisteredDomain(certID uint64, domain, etld, label string) error
+	InsertCTLogEntry(entry *CertificateLogEntry) error
+	GetLogState(url string) (*CertificateLog, error)
+	SaveLogState(certLogObj *CertificateLog) error
+}
+
+// OpenStore constructs a Store from a DSN, dispatching on URL scheme:
+// mysql+tcp:// (the original RecombineURLForDB-compatible backend),
+// postgres://, or sqlite://. This replaces calling RecombineURLForDB
+// directly for code that wants to remain backend-agnostic.
+func OpenStore(dsn string) (Store, error) {
+	dsn = strings.TrimSpace(dsn)
+	dbURL, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch dbURL.Scheme {
+	case "mysql+tcp":
+		return openMySQLStore(dsn)
+	case "postgres":
+		return openPostgresStore(dsn)
+	case "sqlite":
+		return openSQLiteStore(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported store scheme %#v in DSN %#v", dbURL.Scheme, dsn)
+	}
+}
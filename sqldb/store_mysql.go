@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/go-gorp/gorp"
+)
+
+// openMySQLStore opens the original gorp-backed MySQL Store from a
+// mysql+tcp:// DSN, using RecombineURLForDB for the driver-specific
+// connection string.
+func openMySQLStore(dsn string) (Store, error) {
+	edb, err := OpenEntriesDatabase(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return edb, edb.InitTables()
+}
+
+// OpenEntriesDatabase opens a mysql+tcp:// DSN via RecombineURLForDB and
+// returns the gorp-backed EntriesDatabase wired to it. This is the
+// connection logic shared by openMySQLStore and by callers, such as
+// ct-sql-netscan, that need the concrete *EntriesDatabase for operations
+// (e.g. the netscan queue) that aren't part of the generic Store interface.
+// Callers are responsible for setting any fields they need (SQLDebug,
+// Verbose, ...) and calling InitTables before use.
+func OpenEntriesDatabase(dsn string) (*EntriesDatabase, error) {
+	dbConnectStr, err := RecombineURLForDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dbConnectStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open SQL: %s: %s", dbConnectStr, err)
+	}
+	if err = db.Ping(); err != nil {
+		return nil, fmt.Errorf("unable to ping SQL: %s: %s", dbConnectStr, err)
+	}
+
+	dialect := gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}
+	dbMap := &gorp.DbMap{Db: db, Dialect: dialect}
+
+	return &EntriesDatabase{
+		DbMap:        dbMap,
+		KnownIssuers: make(map[string]int),
+	}, nil
+}
+
+// InsertCertificate implements Store on top of the existing gorp insertion
+// path, translating the typed params into the Certificate struct that
+// insertCertificate already knows how to write.
+func (edb *EntriesDatabase) InsertCertificate(params AddCertificateParams) (uint64, error) {
+	txn, err := edb.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	certObj := &Certificate{
+		Serial:    params.Serial,
+		IssuerID:  params.IssuerID,
+		Subject:   params.Subject,
+		NotBefore: params.NotBefore,
+		NotAfter:  params.NotAfter,
+		SHA256:    params.SHA256,
+	}
+
+	err = txn.Insert(certObj)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+
+	return certObj.CertID, txn.Commit()
+}
+
+// FindCertBySerialAndIssuer implements Store's (serial, issuerID) lookup.
+// insertCertificate's own collision handling looks certificates up by
+// sha256 instead.
+func (edb *EntriesDatabase) FindCertBySerialAndIssuer(params FindCertBySerialAndIssuerParams) (uint64, error) {
+	var certID uint64
+	err := edb.DbMap.SelectOne(&certID, "SELECT certID FROM certificate WHERE serial = ? AND issuerID = ?",
+		params.Serial, params.IssuerID)
+	return certID, err
+}
+
+// GetOrInsertName implements Store's FQDN lookup/insert outside of the
+// certificate-insertion transaction, for callers that only need a NameID.
+// Unlike the internal getOrInsertName used by insertCertificate, this does
+// not queue the name for netscan resolution, matching the Postgres and
+// SQLite Store implementations, which have no equivalent queue to feed.
+func (edb *EntriesDatabase) GetOrInsertName(name string) (uint64, error) {
+	txn, err := edb.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	fqdnObj := &FQDN{Name: name}
+	err = txn.Insert(fqdnObj)
+	nameID := fqdnObj.NameID
+	if err != nil {
+		if errorIsNotDuplicate(err) {
+			txn.Rollback()
+			return 0, err
+		}
+
+		if err := txn.SelectOne(&nameID, "SELECT nameID FROM fqdn WHERE name = ? LIMIT 1", name); err != nil {
+			txn.Rollback()
+			return 0, fmt.Errorf("unexpected error finding a FQDN after getting an insertion error: %#v: %s", fqdnObj, err)
+		}
+	}
+
+	if nameID == 0 {
+		txn.Rollback()
+		return 0, fmt.Errorf("failed to obtain NameID")
+	}
+
+	return nameID, txn.Commit()
+}
+
+// InsertRegisteredDomain implements Store by reusing the existing
+// insertRegisteredDomain helper within its own transaction.
+func (edb *EntriesDatabase) InsertRegisteredDomain(certID uint64, domain, etld, label string) error {
+	txn, err := edb.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := edb.insertRegisteredDomain(txn, certID, domain, etld, label); err != nil {
+		txn.Rollback()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// InsertCTLogEntry implements Store's log-entry insertion, ignoring
+// duplicate-entry errors the same way InsertCTEntry does.
+func (edb *EntriesDatabase) InsertCTLogEntry(entry *CertificateLogEntry) error {
+	err := edb.DbMap.Insert(entry)
+	if errorIsNotDuplicate(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore is a Store backed by Postgres, primarily so this corpus can
+// be loaded alongside crt.sh's certwatch dumps, which ship as Postgres-only.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// MigrationsDir is where every Store implementation looks for its versioned
+// schema files, keyed by dialect subdirectory ("mysql", "postgres",
+// "sqlite").
+var MigrationsDir = "migrations"
+
+func openPostgresStore(dsn string) (Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	store := &postgresStore{db: db}
+	return store, store.InitTables()
+}
+
+func (s *postgresStore) InitTables() error {
+	return applyMigrations(s.db, "postgres", MigrationsDir,
+		"SELECT COUNT(*) FROM schema_migrations WHERE filename = $1",
+		"INSERT INTO schema_migrations (filename) VALUES ($1)")
+}
+
+func (s *postgresStore) InsertCertificate(params AddCertificateParams) (uint64, error) {
+	var certID uint64
+	err := s.db.QueryRow(
+		`INSERT INTO certificate (serial, issuerID, subject, notBefore, notAfter, sha256)
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING certID`,
+		params.Serial, params.IssuerID, params.Subject, params.NotBefore, params.NotAfter, params.SHA256).Scan(&certID)
+	return certID, err
+}
+
+func (s *postgresStore) FindCertBySerialAndIssuer(params FindCertBySerialAndIssuerParams) (uint64, error) {
+	var certID uint64
+	err := s.db.QueryRow(
+		"SELECT certID FROM certificate WHERE serial = $1 AND issuerID = $2",
+		params.Serial, params.IssuerID).Scan(&certID)
+	return certID, err
+}
+
+func (s *postgresStore) GetOrInsertName(name string) (uint64, error) {
+	var nameID uint64
+	err := s.db.QueryRow(
+		`INSERT INTO fqdn (name) VALUES ($1)
+		 ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		 RETURNING nameID`, name).Scan(&nameID)
+	return nameID, err
+}
+
+func (s *postgresStore) InsertRegisteredDomain(certID uint64, domain, etld, label string) error {
+	var regDomID uint64
+	err := s.db.QueryRow(
+		`INSERT INTO registereddomain (domain, etld, label) VALUES ($1, $2, $3)
+		 ON CONFLICT (domain) DO UPDATE SET domain = EXCLUDED.domain
+		 RETURNING regdomID`, domain, etld, label).Scan(&regDomID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO cert_registereddomain (regdomID, certID) VALUES ($1, $2)
+		 ON CONFLICT DO NOTHING`, regDomID, certID)
+	return err
+}
+
+func (s *postgresStore) InsertCTLogEntry(entry *CertificateLogEntry) error {
+	_, err := s.db.Exec(
+		`INSERT INTO ctlogentry (certID, logID, entryId, entryTime) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT DO NOTHING`,
+		entry.CertID, entry.LogID, entry.EntryID, entry.EntryTime)
+	return err
+}
+
+func (s *postgresStore) GetLogState(url string) (*CertificateLog, error) {
+	var certLogObj CertificateLog
+	err := s.db.QueryRow("SELECT logID, url, maxEntry, lastEntryTime FROM ctlog WHERE url = $1", url).
+		Scan(&certLogObj.LogID, &certLogObj.URL, &certLogObj.MaxEntry, &certLogObj.LastEntryTime)
+	if err != nil {
+		certLogObj.URL = url
+		err = s.db.QueryRow(
+			"INSERT INTO ctlog (url, maxEntry, lastEntryTime) VALUES ($1, 0, now()) RETURNING logID",
+			url).Scan(&certLogObj.LogID)
+	}
+	return &certLogObj, err
+}
+
+func (s *postgresStore) SaveLogState(certLogObj *CertificateLog) error {
+	_, err := s.db.Exec(
+		"UPDATE ctlog SET maxEntry = $1, lastEntryTime = $2 WHERE logID = $3",
+		certLogObj.MaxEntry, certLogObj.LastEntryTime, certLogObj.LogID)
+	return err
+}
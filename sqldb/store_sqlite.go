@@ -0,0 +1,118 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package sqldb
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore is a Store backed by SQLite, intended for lightweight local
+// analysis of a CT log slice without standing up a MySQL or Postgres server.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(dsn string) (Store, error) {
+	path := strings.TrimPrefix(dsn, "sqlite://")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	store := &sqliteStore{db: db}
+	return store, store.InitTables()
+}
+
+func (s *sqliteStore) InitTables() error {
+	return applyMigrations(s.db, "sqlite", MigrationsDir,
+		"SELECT COUNT(*) FROM schema_migrations WHERE filename = ?",
+		"INSERT INTO schema_migrations (filename) VALUES (?)")
+}
+
+func (s *sqliteStore) InsertCertificate(params AddCertificateParams) (uint64, error) {
+	result, err := s.db.Exec(
+		`INSERT INTO certificate (serial, issuerID, subject, notBefore, notAfter, sha256)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		params.Serial, params.IssuerID, params.Subject, params.NotBefore, params.NotAfter, params.SHA256)
+	if err != nil {
+		return 0, err
+	}
+
+	certID, err := result.LastInsertId()
+	return uint64(certID), err
+}
+
+func (s *sqliteStore) FindCertBySerialAndIssuer(params FindCertBySerialAndIssuerParams) (uint64, error) {
+	var certID uint64
+	err := s.db.QueryRow(
+		"SELECT certID FROM certificate WHERE serial = ? AND issuerID = ?",
+		params.Serial, params.IssuerID).Scan(&certID)
+	return certID, err
+}
+
+func (s *sqliteStore) GetOrInsertName(name string) (uint64, error) {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO fqdn (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+
+	var nameID uint64
+	err = s.db.QueryRow("SELECT nameID FROM fqdn WHERE name = ?", name).Scan(&nameID)
+	return nameID, err
+}
+
+func (s *sqliteStore) InsertRegisteredDomain(certID uint64, domain, etld, label string) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO registereddomain (domain, etld, label) VALUES (?, ?, ?)",
+		domain, etld, label)
+	if err != nil {
+		return err
+	}
+
+	var regDomID uint64
+	if err := s.db.QueryRow("SELECT regdomID FROM registereddomain WHERE domain = ?", domain).Scan(&regDomID); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR IGNORE INTO cert_registereddomain (regdomID, certID) VALUES (?, ?)", regDomID, certID)
+	return err
+}
+
+func (s *sqliteStore) InsertCTLogEntry(entry *CertificateLogEntry) error {
+	_, err := s.db.Exec(
+		"INSERT OR IGNORE INTO ctlogentry (certID, logID, entryId, entryTime) VALUES (?, ?, ?, ?)",
+		entry.CertID, entry.LogID, entry.EntryID, entry.EntryTime)
+	return err
+}
+
+func (s *sqliteStore) GetLogState(url string) (*CertificateLog, error) {
+	var certLogObj CertificateLog
+	err := s.db.QueryRow("SELECT logID, url, maxEntry, lastEntryTime FROM ctlog WHERE url = ?", url).
+		Scan(&certLogObj.LogID, &certLogObj.URL, &certLogObj.MaxEntry, &certLogObj.LastEntryTime)
+	if err != nil {
+		certLogObj.URL = url
+		result, insertErr := s.db.Exec("INSERT INTO ctlog (url, maxEntry, lastEntryTime) VALUES (?, 0, datetime('now'))", url)
+		if insertErr != nil {
+			return &certLogObj, insertErr
+		}
+		logID, insertErr := result.LastInsertId()
+		certLogObj.LogID = int(logID)
+		return &certLogObj, insertErr
+	}
+	return &certLogObj, nil
+}
+
+func (s *sqliteStore) SaveLogState(certLogObj *CertificateLog) error {
+	_, err := s.db.Exec(
+		"UPDATE ctlog SET maxEntry = ?, lastEntryTime = ? WHERE logID = ?",
+		certLogObj.MaxEntry, certLogObj.LastEntryTime, certLogObj.LogID)
+	return err
+}
@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FolderDatabase stores raw certificate DER bodies on disk, content-addressed
+// by their SHA-256 fingerprint: a cert with fingerprint "abcdef..." is
+// written to <root>/ab/cd/abcdef....der. Splitting on the first two bytes of
+// the fingerprint keeps any one directory from accumulating millions of
+// entries, which chokes most filesystems long before running out of space.
+type FolderDatabase struct {
+	Root string
+}
+
+// NewFolderDatabase returns a FolderDatabase rooted at root, creating it if
+// it doesn't already exist.
+func NewFolderDatabase(root string) (*FolderDatabase, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FolderDatabase{Root: root}, nil
+}
+
+// pathForFingerprint returns the on-disk path for a hex-encoded sha256
+// fingerprint, creating its two levels of parent directory.
+func (f *FolderDatabase) pathForFingerprint(sha256Hex string) (string, error) {
+	if len(sha256Hex) < 4 {
+		return "", fmt.Errorf("fingerprint %q is too short to shard", sha256Hex)
+	}
+	dir := filepath.Join(f.Root, sha256Hex[0:2], sha256Hex[2:4])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, sha256Hex+".der"), nil
+}
+
+// StoreByFingerprint writes der to disk under sha256Hex's fingerprint path.
+// It is a no-op if a file is already there, since dedup means two callers
+// can race to store the same certificate.
+func (f *FolderDatabase) StoreByFingerprint(sha256Hex string, der []byte) error {
+	path, err := f.pathForFingerprint(sha256Hex)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, der, 0644)
+}
+
+// FetchByFingerprint reads back the raw certificate stored under sha256Hex.
+func (f *FolderDatabase) FetchByFingerprint(sha256Hex string) ([]byte, error) {
+	path, err := f.pathForFingerprint(sha256Hex)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// pathForSerial returns the pre-fingerprint on-disk path for a certificate,
+// keyed by issuerID and serial number. StoreByFingerprint/FetchByFingerprint
+// superseded this layout; FetchBySerial exists only so BackfillSHA256 can
+// still read certificates that were written before the fingerprint scheme
+// existed.
+func (f *FolderDatabase) pathForSerial(issuerID int, serial string) string {
+	return filepath.Join(f.Root, fmt.Sprintf("%d", issuerID), serial+".der")
+}
+
+// FetchBySerial reads back a certificate stored under the legacy
+// issuerID/serial layout.
+func (f *FolderDatabase) FetchBySerial(issuerID int, serial string) ([]byte, error) {
+	return ioutil.ReadFile(f.pathForSerial(issuerID, serial))
+}